@@ -0,0 +1,89 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-blockservice/pinning"
+)
+
+// defaultBandwidthInterval is how often the bandwidth served by a dedicated
+// gateway is reported to the pinning service.
+const defaultBandwidthInterval = 10 * time.Second
+
+// bandwidthFlushTimeout bounds a single report of the pending bandwidth.
+const bandwidthFlushTimeout = time.Minute
+
+// bandwidthReporter aggregates the bandwidth served per block and reports it
+// to the pinning service in the background, so that reads never wait on it.
+// Amounts that could not be reported are kept for the next report.
+type bandwidthReporter struct {
+	client pinning.Client
+
+	lk      sync.Mutex
+	pending map[string]uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newBandwidthReporter(client pinning.Client, interval time.Duration) *bandwidthReporter {
+	r := &bandwidthReporter{
+		client:  client,
+		pending: make(map[string]uint64),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.run(interval)
+	return r
+}
+
+// add accounts amount bytes served for the block whose multihash is hash.
+func (r *bandwidthReporter) add(hash string, amount uint64) {
+	r.lk.Lock()
+	r.pending[hash] += amount
+	r.lk.Unlock()
+}
+
+func (r *bandwidthReporter) run(interval time.Duration) {
+	defer close(r.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.flush()
+		case <-r.stop:
+			r.flush()
+			return
+		}
+	}
+}
+
+// flush reports the pending bandwidth.
+func (r *bandwidthReporter) flush() {
+	r.lk.Lock()
+	pending := r.pending
+	r.pending = make(map[string]uint64)
+	r.lk.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bandwidthFlushTimeout)
+	defer cancel()
+	for hash, amount := range pending {
+		if err := r.client.ReportBandwidth(ctx, hash, amount); err != nil {
+			logger.Debugf("could not report the bandwidth of %s: %s", hash, err)
+			r.add(hash, amount)
+		}
+	}
+}
+
+// close reports the pending bandwidth a last time and stops the reporter.
+// Amounts that still cannot be reported are dropped.
+func (r *bandwidthReporter) close() {
+	close(r.stop)
+	<-r.done
+}
@@ -4,19 +4,15 @@
 package blockservice
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
-	"net/http"
-	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
@@ -28,9 +24,10 @@ import (
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/go-verifcid"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/ipfs/go-blockservice/internal"
-	"github.com/redis/go-redis/v9"
+	"github.com/ipfs/go-blockservice/uploader"
 )
 
 var logger = logging.Logger("blockservice")
@@ -76,16 +73,42 @@ type BlockService interface {
 }
 
 type blockService struct {
+	config
+
 	blockstore blockstore.Blockstore
 	exchange   exchange.Interface
 	// If checkFirst is true then first check that a block doesn't
 	// already exist to avoid republishing the block on the exchange.
 	checkFirst bool
-}
-
+	// inflight collapses concurrent CDN fetches of the same block.
+	inflight singleflight.Group
+	// buffer aggregates small writes, it is nil unless configured with
+	// WithWriteBuffer.
+	buffer *writeBuffer
+	// bandwidth reports the bandwidth served by a dedicated gateway, it is
+	// nil unless configured with WithDedicatedGateway and a pinning service.
+	bandwidth *bandwidthReporter
+	// stop stops the background workers, like the compaction started by
+	// WithCompaction and the replay of the journal.
+	stop    chan struct{}
+	workers sync.WaitGroup
+	// closeOnce shuts the blockservice down on the first call to Close,
+	// whose result is kept in closeErr for the next ones.
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// fileRecord is the index entry of a user, pointing at the pack they append
+// to. It has the same fields as PackInfo.
 type fileRecord struct {
 	FileRecordID string
 	Size         uint64
+	Blocks       int
+	Created      time.Time
+}
+
+func (fr fileRecord) packInfo() PackInfo {
+	return PackInfo(fr)
 }
 
 type fileInfo struct {
@@ -94,66 +117,62 @@ type fileInfo struct {
 	Offset       uint64
 }
 
-var (
-	uploader           string
-	pinningService     string
-	apiKey             string
-	isDedicatedGateway bool
-	rdb                *redis.ClusterClient
-)
-
-func InitBlockService(uploaderURL, pinningServiceURL, _apiKey string, _isDedicatedGateway bool) error {
-	if uploaderURL != "" {
-		uploader = uploaderURL
-	}
-	if pinningServiceURL != "" {
-		pinningService = pinningServiceURL
-	}
-	if _apiKey != "" {
-		apiKey = _apiKey
-	}
-	isDedicatedGateway = _isDedicatedGateway
-
-	// Return an error if any of the URLs is empty.
-	if uploader == "" || pinningService == "" || apiKey == "" {
-		return errors.New("error: empty url or api key")
-	}
-	rdb = redis.NewClusterClient(&redis.ClusterOptions{
-		// Addrs: []string{"10.148.0.23:7001", "10.148.0.23:7002", "10.148.0.23:7003", "10.148.0.23:7004", "10.148.0.23:7005", "10.148.0.23:7006"},
-		Addrs: []string{"10.0.0.185:7001", "10.0.0.185:7002", "10.0.0.185:7003", "10.0.0.185:7004", "10.0.0.185:7005", "10.0.0.185:7006"},
-	})
-
-	ctx := context.Background()
-
-	rdb.Ping(ctx)
-	return nil
-}
-
-// NewBlockService creates a BlockService with given datastore instance.
-func New(bs blockstore.Blockstore, rem exchange.Interface) BlockService {
+// NewBlockService creates a BlockService with given datastore instance. bs may
+// be nil when the blocks are kept in the CDN, it is then skipped.
+func New(bs blockstore.Blockstore, rem exchange.Interface, opts ...Option) BlockService {
 	if rem == nil {
 		logger.Debug("blockservice running in local (offline) mode.")
 	}
 
-	return &blockService{
-		blockstore: bs,
-		exchange:   rem,
-		checkFirst: true,
-	}
+	return newBlockService(bs, rem, true, opts)
 }
 
 // NewWriteThrough creates a BlockService that guarantees writes will go
 // through to the blockstore and are not skipped by cache checks.
-func NewWriteThrough(bs blockstore.Blockstore, rem exchange.Interface) BlockService {
+func NewWriteThrough(bs blockstore.Blockstore, rem exchange.Interface, opts ...Option) BlockService {
 	if rem == nil {
 		logger.Debug("blockservice running in local (offline) mode.")
 	}
 
-	return &blockService{
+	return newBlockService(bs, rem, false, opts)
+}
+
+func newBlockService(bs blockstore.Blockstore, rem exchange.Interface, checkFirst bool, opts []Option) *blockService {
+	s := &blockService{
+		config:     newConfig(opts),
 		blockstore: bs,
 		exchange:   rem,
-		checkFirst: false,
+		checkFirst: checkFirst,
+	}
+	if s.isDedicatedGateway && s.pinningClient != nil {
+		s.bandwidth = newBandwidthReporter(s.pinningClient, defaultBandwidthInterval)
+	}
+	if s.cdnEnabled() && s.bufferBytes > 0 {
+		s.buffer = newWriteBuffer(s.bufferBytes, s.bufferLimit, s.bufferDelay, s.policy(), s.flushBuffered)
 	}
+	if s.cdnEnabled() && s.journal != nil {
+		s.startWorker(func(stop <-chan struct{}) {
+			s.runJournalReplay(journalReplayInterval, stop)
+		})
+	}
+	if s.cdnEnabled() && s.compaction != nil {
+		s.startWorker(func(stop <-chan struct{}) {
+			s.runCompaction(s.compaction.interval, s.compaction.opts, stop)
+		})
+	}
+	return s
+}
+
+// startWorker runs fn in the background until Close closes its stop channel.
+func (s *blockService) startWorker(fn func(stop <-chan struct{})) {
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn(s.stop)
+	}()
 }
 
 // Blockstore returns the blockstore behind this blockservice.
@@ -172,9 +191,17 @@ func (s *blockService) Exchange() exchange.Interface {
 // session will be created. Otherwise, the current exchange will be used
 // directly.
 func NewSession(ctx context.Context, bs BlockService) *Session {
+	bserv, ok := bs.(*blockService)
+	if !ok {
+		// Foreign BlockService implementations carry no CDN configuration,
+		// serve them from their blockstore and exchange only.
+		bserv = &blockService{config: newConfig(nil), blockstore: bs.Blockstore(), exchange: bs.Exchange()}
+	}
+
 	exch := bs.Exchange()
 	if sessEx, ok := exch.(exchange.SessionExchange); ok {
 		return &Session{
+			bserv:    bserv,
 			sessCtx:  ctx,
 			ses:      nil,
 			sessEx:   sessEx,
@@ -183,6 +210,7 @@ func NewSession(ctx context.Context, bs BlockService) *Session {
 		}
 	}
 	return &Session{
+		bserv:    bserv,
 		ses:      exch,
 		sessCtx:  ctx,
 		bs:       bs.Blockstore(),
@@ -190,299 +218,171 @@ func NewSession(ctx context.Context, bs BlockService) *Session {
 	}
 }
 
-type ZipReader struct {
-	File []File
-}
-type File struct {
-	Name               string `json:"Name"`
-	CompressedSize     uint32 `json:"CompressedSize"`
-	UncompressedSize   uint32 `json:"UncompressedSize"`
-	CompressedSize64   uint64 `json:"CompressedSize64"`
-	UncompressedSize64 uint64 `json:"UncompressedSize64"`
-	Offset             uint64 `json:"Offset"`
-}
+// ZipReader is the listing of the files stored in a pack.
+type ZipReader = uploader.ZipReader
+
+// File describes a file stored in a pack.
+type File = uploader.File
 
 // AddBlock adds a particular block to the service, Putting it into the datastore.
 func (s *blockService) AddBlock(ctx context.Context, o blocks.Block) error {
 	ctx, span := internal.StartSpan(ctx, "blockService.AddBlock")
 	defer span.End()
 
-	err := AddBlock(ctx, o, s.checkFirst)
-	if err != nil {
-		return err
-	}
-
-	if s.exchange != nil {
-		if err := s.exchange.NotifyNewBlocks(ctx, o); err != nil {
-			logger.Errorf("NotifyNewBlocks: %s", err.Error())
-		}
-	}
-
-	return nil
-}
-
-func AddBlock(ctx context.Context, o blocks.Block, checkFirst bool) error {
-	var fr fileRecord
-	userID, _ := ctx.Value("userID").(string)
-	if userID != "" {
-		userKV, err := rdb.Get(ctx, userID).Bytes()
-		if err != nil {
-			return nil
-		} else {
-			if err := json.Unmarshal(userKV, &fr); err != nil {
-				return err
-			}
-		}
-	}
-
 	c := o.Cid()
 	// hash security
-	if err := verifcid.ValidateCid(c); err != nil {
-		return err
-	}
-
-	_, err := rdb.Get(ctx, c.Hash().HexString()).Bytes()
-	if err == nil {
-		return nil
-	}
-
-	hash, err := internal.GetHashStringFromCid(c.String())
+	err := verifcid.ValidateCid(c)
 	if err != nil {
 		return err
 	}
-	// Create a temporary file with the name being the hash of the CID
-	tmpFile, err := os.Create(hash)
-	if err != nil {
-		return fmt.Errorf("failed to create temporary file: %w", err)
-	}
-	defer os.Remove(tmpFile.Name()) // clean up the temporary file
 
-	// Write the block data to the temporary file
-	_, err = tmpFile.Write(o.RawData())
-	if err != nil {
-		return fmt.Errorf("failed to write block data to temporary file: %w", err)
-	}
-	if err = tmpFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temporary file: %w", err)
-	}
-
-	var (
-		fileRecordID = fr.FileRecordID
-		lastSize     uint64
-		files        []File
-	)
-	if fr.FileRecordID == "" || fr.Size > 100*1024*1024 {
-		fileRecordID, files, lastSize, err = uploadFiles([]string{tmpFile.Name()}, userID)
+	if s.cdnEnabled() {
+		err = s.addBlockCdn(ctx, o)
 		if err != nil {
-			return fmt.Errorf("failed to upload file and get file record ID: %w", err)
+			return err
 		}
 	} else {
-		files, lastSize, err = appendFiles([]string{tmpFile.Name()}, fileRecordID, userID)
-		if err != nil {
-			fileRecordID, files, lastSize, err = uploadFiles([]string{tmpFile.Name()}, userID)
-			if err != nil {
-				return fmt.Errorf("failed to upload file and get file record ID: %w", err)
+		if s.checkFirst {
+			if has, err := s.blockstore.Has(ctx, c); has || err != nil {
+				return err
 			}
 		}
-	}
 
-	if userID != "" {
-		f := fileRecord{fileRecordID, lastSize}
-		bf, err := json.Marshal(f)
-		if err != nil {
-			return fmt.Errorf("failed to marshal `fileInfo`: %w", err)
-		}
-		if statusCmd := rdb.Set(ctx, userID, []byte(bf), 0); statusCmd.Err() != nil {
-			return fmt.Errorf("failed to put data in Redis: %w", statusCmd.Err())
+		if err := s.blockstore.Put(ctx, o); err != nil {
+			return err
 		}
+
+		logger.Debugf("BlockService.BlockAdded %s", c)
 	}
-	for _, f := range files {
-		if strings.Contains(f.Name, o.Cid().Hash().String()) {
-			fInfo := fileInfo{fileRecordID, f.CompressedSize64, f.Offset}
-			fInfoBytes, err := json.Marshal(fInfo)
-			if err != nil {
-				return err
-			}
-			if statusCmd := rdb.Set(ctx, o.Cid().Hash().HexString(), fInfoBytes, 0); statusCmd.Err() != nil {
-				return statusCmd.Err()
-			}
-			break
+
+	if s.exchange != nil {
+		if err := s.exchange.NotifyNewBlocks(ctx, o); err != nil {
+			logger.Errorf("NotifyNewBlocks: %s", err.Error())
 		}
 	}
 
-	logger.Debugf("BlockService.BlockAdded %s", c)
-
 	return nil
 }
 
-func uploadFiles(files []string, userID string) (string, []File, uint64, error) {
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	// Iterate over files and add them as form parts
-	for _, file := range files {
-		part, err := writer.CreateFormFile("file", filepath.Base(file))
-		if err != nil {
-			return "", nil, 0, fmt.Errorf("failed to create form file: %w", err)
-		}
-		f, err := os.Open(file)
-		if err != nil {
-			return "", nil, 0, fmt.Errorf("failed to open file %s: %w", file, err)
-		}
-		defer f.Close()
-		if _, err = io.Copy(part, f); err != nil {
-			return "", nil, 0, fmt.Errorf("failed to copy file content: %w", err)
-		}
-	}
+// addBlockCdn stores o in the uploader CDN and indexes it.
+func (s *blockService) addBlockCdn(ctx context.Context, o blocks.Block) error {
+	_, err := s.addBlocksCdn(ctx, []blocks.Block{o})
+	return err
+}
 
-	// Close the multipart form writer
-	if err := writer.Close(); err != nil {
-		return "", nil, 0, fmt.Errorf("failed to close multipart writer: %w", err)
+// blockParts returns the uploader parts holding the data of bs, named after
+// their multihash. The data is streamed from memory into the upload, unless a
+// temporary directory is configured in which case it is spooled there first.
+// The returned function removes the temporary files.
+func (s *blockService) blockParts(bs []blocks.Block) ([]uploader.Part, func(), error) {
+	parts := make([]uploader.Part, len(bs))
+	if s.tempDir == "" {
+		for i, b := range bs {
+			parts[i] = uploader.BytesPart(b.Cid().Hash().HexString(), b.RawData())
+		}
+		return parts, func() {}, nil
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/packUpload", uploader), body)
-	if err != nil {
-		return "", nil, 0, fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", nil, 0, fmt.Errorf("failed to post raw data: %w", err)
-	}
-	defer resp.Body.Close()
-	type FileRecord struct {
-		ID       string `json:"ID"`
-		Owner    string `json:"owner"`
-		Name     string `json:"name"`
-		Size     int    `json:"size"`
-		ReaderID int    `json:"readerId"`
-	}
-	type Response struct {
-		FileRecord FileRecord
-		ZipReader  ZipReader
-	}
-	var (
-		response     Response
-		fileRecordID string
-		size         uint64
-	)
-	if resp.StatusCode == http.StatusOK {
-		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-			return "", nil, 0, fmt.Errorf("failed to decode response body: %w", err)
+	var tmpFiles []string
+	cleanup := func() {
+		for _, name := range tmpFiles {
+			os.Remove(name)
 		}
-		fileRecordID = response.FileRecord.ID
-		size = response.ZipReader.File[len(files)-1].Offset + response.ZipReader.File[len(files)-1].UncompressedSize64
 	}
-	if userID != "" {
-		// Call the API to create a new file record
-		apiUrl := fmt.Sprintf("%s/api/filerecords/", pinningService)
-		reqBody, _ := json.Marshal(map[string]interface{}{
-			"user_id":        userID,
-			"file_record_id": fileRecordID,
-			"size": size,
-		})
-		reqCreateRecord, _ := http.NewRequest("POST", apiUrl, bytes.NewBuffer(reqBody))
-		reqCreateRecord.Header.Set("blockservice-API-Key", apiKey)
-		reqCreateRecord.Header.Set("Content-Type", "application/json")
-		_, err = client.Do(reqCreateRecord)
+	for i, b := range bs {
+		name, err := spoolBlock(s.tempDir, b)
 		if err != nil {
-			return "", nil, 0, fmt.Errorf("failed to create file record: %w", err)
+			cleanup()
+			return nil, nil, err
+		}
+		tmpFiles = append(tmpFiles, name)
+		parts[i] = uploader.Part{
+			Name: b.Cid().Hash().HexString(),
+			Open: func() (io.ReadCloser, error) {
+				return os.Open(name)
+			},
 		}
 	}
-	return fileRecordID, response.ZipReader.File, size, nil
+	return parts, cleanup, nil
 }
-func appendFiles(files []string, fileRecordId string, userID string) ([]File, uint64, error) {
-	// Create new multipart form writer
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
 
-	// Iterate over files and add them as form parts
-	for _, file := range files {
-		part, err := writer.CreateFormFile("file", filepath.Base(file))
-		if err != nil {
-			return nil, 0, fmt.Errorf("failed to create form file: %w", err)
-		}
-		f, err := os.Open(file)
-		if err != nil {
-			return nil, 0, fmt.Errorf("failed to open file %s: %w", file, err)
-		}
-		defer f.Close()
-		if _, err = io.Copy(part, f); err != nil {
-			return nil, 0, fmt.Errorf("failed to copy file content: %w", err)
-		}
+// spoolBlock writes the data of b to a new file in dir and returns its name.
+func spoolBlock(dir string, b blocks.Block) (string, error) {
+	tmpFile, err := os.CreateTemp(dir, "block-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
 	}
-
-	// Close the multipart form writer
-	if err := writer.Close(); err != nil {
-		return nil, 0, fmt.Errorf("failed to close multipart writer: %w", err)
+	if _, err = tmpFile.Write(b.RawData()); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("failed to write block data to temporary file: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("failed to close temporary file: %w", err)
 	}
+	return tmpFile.Name(), nil
+}
 
-	// Create new HTTP request and set headers
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/zipAction", uploader), body)
+func (s *blockService) uploadFiles(ctx context.Context, parts []uploader.Part) (string, []File, uint64, error) {
+	response, err := s.uploaderClient.Upload(ctx, parts)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to create HTTP request: %w", err)
+		return "", nil, 0, fmt.Errorf("failed to post raw data: %w", uploadError(err))
 	}
+	return response.FileRecord.ID, response.ZipReader.File, response.ZipReader.Size(), nil
+}
 
-	req.URL.RawQuery = url.Values{
-		"file_record_id": {fileRecordId},
-		"action_type":    {"1"},
-	}.Encode()
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	// Send request and handle response
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func (s *blockService) appendFiles(ctx context.Context, parts []uploader.Part, fileRecordId string) ([]File, uint64, error) {
+	response, err := s.uploaderClient.Append(ctx, fileRecordId, parts)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to send HTTP request: %w", err)
+		return nil, 0, fmt.Errorf("failed to append to file record %s: %w", fileRecordId, uploadError(err))
 	}
-	defer resp.Body.Close()
+	return response.File, response.Size(), nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, 0, fmt.Errorf("server returned status %d, reqURI: %s, file record id: %s", resp.StatusCode, req.URL.String(), fileRecordId)
-	}
+func (s *blockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
+	ctx, span := internal.StartSpan(ctx, "blockService.AddBlocks")
+	defer span.End()
 
-	var (
-		response      ZipReader
-		lastFileIndex int
-		lastSize      uint64
-	)
-	if resp.StatusCode == http.StatusOK {
-		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-			return nil, 0, fmt.Errorf("failed to decode response body: %w", err)
+	// hash security
+	for _, b := range bs {
+		err := verifcid.ValidateCid(b.Cid())
+		if err != nil {
+			return err
 		}
-		lastFileIndex = len(response.File) - 1
-
-		lastSize = response.File[lastFileIndex].Offset + response.File[lastFileIndex].UncompressedSize64
-
 	}
 
-	if userID != "" {
-		// Call the API to create a new file record
-		apiUrl := fmt.Sprintf("%s/api/filerecords/", pinningService)
-		reqBody, _ := json.Marshal(map[string]interface{}{
-			"user_id":        userID,
-			"file_record_id": fileRecordId,
-			"size": lastSize,
-		})
-		reqCreateRecord, _ := http.NewRequest("POST", apiUrl, bytes.NewBuffer(reqBody))
-		reqCreateRecord.Header.Set("blockservice-API-Key", apiKey)
-		reqCreateRecord.Header.Set("Content-Type", "application/json")
-		_, err = client.Do(reqCreateRecord)
+	var toput []blocks.Block
+	if s.cdnEnabled() {
+		var err error
+		toput, err = s.addBlocksCdn(ctx, bs)
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to create file record: %w", err)
+			return err
+		}
+	} else {
+		if s.checkFirst {
+			toput = make([]blocks.Block, 0, len(bs))
+			for _, b := range bs {
+				has, err := s.blockstore.Has(ctx, b.Cid())
+				if err != nil {
+					return err
+				}
+				if !has {
+					toput = append(toput, b)
+				}
+			}
+		} else {
+			toput = bs
 		}
-	}
-
-	return response.File, lastSize, nil
-}
-
 
-func (s *blockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
-	ctx, span := internal.StartSpan(ctx, "blockService.AddBlocks")
-	defer span.End()
+		if len(toput) == 0 {
+			return nil
+		}
 
-	toput, err := AddBlocks(ctx, bs, s.checkFirst)
-	if err != nil {
-		return err
+		err := s.blockstore.PutMany(ctx, toput)
+		if err != nil {
+			return err
+		}
 	}
 
 	if s.exchange != nil {
@@ -494,37 +394,90 @@ func (s *blockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
 	return nil
 }
 
-func AddBlocks(ctx context.Context, bs []blocks.Block, checkFirst bool) ([]blocks.Block, error) {
+// addBlocksCdn stores bs in the uploader CDN, or in the write buffer if there
+// is one, and returns the blocks that were not already stored.
+func (s *blockService) addBlocksCdn(ctx context.Context, bs []blocks.Block) ([]blocks.Block, error) {
+	if s.buffer != nil {
+		userID, _ := ctx.Value("userID").(string)
+		added, err := s.buffer.add(ctx, userID, bs)
+		if err != errBufferClosed && err != errBufferFull {
+			return added, err
+		}
+	}
+	return s.writeBlocksCdn(ctx, bs)
+}
+
+// flushBuffered writes the blocks buffered for userID to the CDN.
+func (s *blockService) flushBuffered(ctx context.Context, userID string, bs []blocks.Block) error {
+	ctx, span := internal.StartSpan(ctx, "blockService.flushBuffered", trace.WithAttributes(attribute.Int("blocks", len(bs))))
+	defer span.End()
+
+	_, err := s.writeBlocksCdn(ctx, bs)
+	return err
+}
+
+// writeBlocksCdn uploads the blocks of bs that are not indexed yet to the pack
+// of the user, and indexes them.
+func (s *blockService) writeBlocksCdn(ctx context.Context, bs []blocks.Block) ([]blocks.Block, error) {
 	var fr fileRecord
 	var toput []blocks.Block
 
 	userID, _ := ctx.Value("userID").(string)
 	if userID != "" {
-		userKV, err := rdb.Get(ctx, userID).Bytes()
+		// The pack of the user is read, appended to and updated under the
+		// user lock, and stop if it is lost.
+		var (
+			unlock func()
+			err    error
+		)
+		ctx, unlock, err = s.userLocker.Lock(ctx, userID)
 		if err != nil {
-			return toput, nil
-		} else {
-			if err := json.Unmarshal(userKV, &fr); err != nil {
-				return nil, err
-			}
+			return nil, fmt.Errorf("failed to lock user %s: %w", userID, indexError(err))
 		}
-	}
+		defer unlock()
 
-	// hash security
-	for _, b := range bs {
-		err := verifcid.ValidateCid(b.Cid())
-		if err != nil {
+		fr, err = s.getFileRecord(ctx, userID)
+		// A user without a record has not uploaded anything yet, their
+		// blocks go to a new pack.
+		if err != nil && !errors.Is(err, ErrIndexNotFound) {
 			return nil, err
 		}
 	}
 
+	keys := make([]string, len(bs))
+	for i, b := range bs {
+		keys[i] = blockKey(b.Cid().Hash())
+	}
+	existing, err := s.index.BatchGet(ctx, keys)
+	if err != nil {
+		return nil, indexError(err)
+	}
+
+	// Blocks already stored are not uploaded again, but accounted to the
+	// user too.
 	toput = make([]blocks.Block, 0, len(bs))
-	for _, b := range bs {
-		_, err := rdb.Get(ctx, b.Cid().Hash().HexString()).Bytes()
-		if err == nil {
-			continue // Skip already added block
-		} else {
+	stored := make(map[string]fileInfo)
+	for i, b := range bs {
+		if existing[i] == nil {
 			toput = append(toput, b)
+			continue
+		}
+		var f fileInfo
+		if err := json.Unmarshal(existing[i], &f); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal `fileInfo`: %w", err)
+		}
+		stored[keys[i]] = f
+	}
+	gone, err := s.claimBlocks(ctx, userID, stored)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range gone {
+		for i, b := range bs {
+			if keys[i] == key {
+				toput = append(toput, b)
+				break
+			}
 		}
 	}
 
@@ -532,52 +485,72 @@ func AddBlocks(ctx context.Context, bs []blocks.Block, checkFirst bool) ([]block
 		return toput, nil
 	}
 
-	tempFiles := make([]string, len(toput))
+	parts, cleanup, err := s.blockParts(toput)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	var size uint64
+	putKeys := make([]string, len(toput))
 	for i, b := range toput {
-		tempFile, err := os.Create(b.Cid().Hash().String())
-		if err != nil {
-			return nil, err
-		}
-		defer os.Remove(tempFile.Name())
-		_, err = tempFile.Write(b.RawData())
-		if err != nil {
-			return nil, err
-		}
-		tempFiles[i] = tempFile.Name()
+		size += uint64(len(b.RawData()))
+		putKeys[i] = blockKey(b.Cid().Hash())
 	}
 
+	// The write is journaled before the upload, so that a crash during the
+	// upload leaves a trace.
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
 	var (
 		fileRecordID = fr.FileRecordID
+		created      = fr.Created
 		lastSize     uint64
-		err          error
 		files        []File
 	)
-	if fr.FileRecordID == "" || fr.Size > 100*1024*1024 {
-		fileRecordID, files, lastSize, err = uploadFiles(tempFiles, userID)
+	if fr.FileRecordID == "" || s.packPolicy.Rollover(ctx, userID, fr.packInfo(), len(toput), size) {
+		uctx, err := s.journalIntent(ctx, id, userID, fileRecord{}, putKeys)
+		if err != nil {
+			return nil, err
+		}
+		fileRecordID, files, lastSize, err = s.uploadFiles(uctx, parts)
 		if err != nil {
+			s.dropIntent(ctx, id)
 			return nil, fmt.Errorf("failed to upload file and get file record ID: %w", err)
 		}
+		created = time.Now()
 	} else {
-		files, lastSize, err = appendFiles(tempFiles, fileRecordID, userID)
+		uctx, err := s.journalIntent(ctx, id, userID, fr, putKeys)
 		if err != nil {
-			fileRecordID, files, lastSize, err = uploadFiles(tempFiles, userID)
+			return nil, err
+		}
+		files, lastSize, err = s.appendFiles(uctx, parts, fileRecordID)
+		if err != nil {
+			// Transient failures were already retried, only start a new
+			// pack if the uploader refused to append to this one.
+			if !errors.Is(err, ErrUploadRejected) {
+				s.dropIntent(ctx, id)
+				return nil, err
+			}
+			logger.Warnf("could not append to pack %s, starting a new one: %s", fileRecordID, err)
+			// The new upload is a different call, with its own key.
+			uctx, err = s.journalIntent(ctx, id, userID, fileRecord{}, putKeys)
 			if err != nil {
+				s.dropIntent(ctx, id)
+				return nil, err
+			}
+			fileRecordID, files, lastSize, err = s.uploadFiles(uctx, parts)
+			if err != nil {
+				s.dropIntent(ctx, id)
 				return nil, fmt.Errorf("failed to upload file and get file record ID: %w", err)
 			}
+			created = time.Now()
 		}
 	}
 
-	if userID != "" {
-		f := fileRecord{fileRecordID, lastSize}
-		bf, err := json.Marshal(f)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal `fileInfo`: %w", err)
-		}
-		if statusCmd := rdb.Set(ctx, userID, bf, 0); statusCmd.Err() != nil {
-			return nil, fmt.Errorf("failed to put data in Redis: %w", statusCmd.Err())
-		}
-	}
-
+	fInfos := make(map[string][]byte, len(toput))
 	for _, f := range files {
 		for _, b := range toput {
 			if strings.Contains(f.Name, b.Cid().Hash().String()) {
@@ -586,12 +559,26 @@ func AddBlocks(ctx context.Context, bs []blocks.Block, checkFirst bool) ([]block
 				if err != nil {
 					return nil, err
 				}
-				if statusCmd := rdb.Set(ctx, b.Cid().Hash().HexString(), fInfoBytes, 0); statusCmd.Err() != nil {
-					return nil, statusCmd.Err()
-				}
+				fInfos[blockKey(b.Cid().Hash())] = fInfoBytes
 			}
 		}
 	}
+
+	// The complete entry replaces the intent.
+	err = s.commitPackWrite(ctx, JournalEntry{
+		ID:     id,
+		UserID: userID,
+		Record: PackInfo{
+			FileRecordID: fileRecordID,
+			Size:         lastSize,
+			Blocks:       len(files),
+			Created:      created,
+		},
+		Blocks: fInfos,
+	})
+	if err != nil {
+		return nil, err
+	}
 	return toput, nil
 }
 
@@ -606,12 +593,12 @@ func (s *blockService) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, e
 		f = s.getExchange
 	}
 
-	return getBlock(ctx, c, s.blockstore, f) // hash security
+	return s.getBlock(ctx, c, s.blockstore, f) // hash security
 }
 
 func (s *blockService) GetUploader() (string, error) {
-	if uploader != "" {
-		return uploader, nil
+	if s.uploader != "" {
+		return s.uploader, nil
 	}
 	return "", nil
 }
@@ -620,91 +607,98 @@ func (s *blockService) getExchange() notifiableFetcher {
 	return s.exchange
 }
 
-func getBlock(ctx context.Context, c cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) (blocks.Block, error) {
+func (s *blockService) getBlock(ctx context.Context, c cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) (blocks.Block, error) {
 	err := verifcid.ValidateCid(c) // hash security
 	if err != nil {
 		return nil, err
 	}
 
-	kv1, err := rdb.Get(ctx, c.Hash().HexString()).Bytes()
-
-	if err == nil {
-		var f fileInfo
-
-		if err := json.Unmarshal(kv1, &f); err != nil {
-			return nil, err
-		}
-
-		endpoint, err := url.Parse(fmt.Sprintf("%s/cacheFile/%s", uploader, f.FileRecordID))
-		if err != nil {
-			return nil, err
-		}
-
-		rawQuery := endpoint.Query()
-		rawQuery.Set("range", fmt.Sprintf("%d,%d", f.Offset, f.Size))
-		endpoint.RawQuery = rawQuery.Encode()
-		fileUrl := endpoint.String()
+	for _, src := range s.lookupOrder {
+		switch src {
+		case SourceMemory:
+			if blk, ok := s.getBlockCached(ctx, c); ok {
+				return blk, nil
+			}
 
-		fmt.Println(fileUrl)
+		case SourceBlockstore:
+			if bs == nil {
+				continue
+			}
+			blk, err := bs.Get(ctx, c)
+			if err == nil {
+				return blk, nil
+			}
+			if !ipld.IsNotFound(err) {
+				return nil, err
+			}
 
-		resp, err := http.Get(fileUrl)
-		if err != nil {
-			logger.Debugf("Failed to get data %v", err)
-			return nil, err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			logger.Debugf("Request failed with status %d", resp.StatusCode)
-			return nil, err
-		}
+		case SourceCdn:
+			if !s.cdnEnabled() || s.breaker.open() {
+				continue
+			}
+			blk, indexed, err := s.fetchBlockCdn(ctx, c)
+			if err != nil && ctx.Err() != nil {
+				return nil, err
+			}
+			if !indexed {
+				continue
+			}
+			if err != nil {
+				// Like GetBlocks, blocks the CDN fails to serve are looked up
+				// in the next sources.
+				logger.Errorf("%s, falling back to the next source", err)
+				continue
+			}
+			if s.isDedicatedGateway {
+				s.addBandwidthUsage(uint64(len(blk.RawData())), c.Hash().HexString())
+			}
+			return blk, nil
 
-		bdata, err := io.ReadAll(resp.Body)
-		if err != nil {
-			logger.Debugf("Failed read body %v", err)
-			return nil, err
-		}
-		hash, err := internal.GetHashStringFromCid(c.String())
-		if err != nil {
-			logger.Debugf("GetHashFromCidString Error %v", err)
-		}
-		if isDedicatedGateway {
-			addBandwidthUsage(f.Size, hash)
+		case SourceExchange:
+			if fget == nil {
+				continue
+			}
+			return s.getBlockExchange(ctx, c, bs, fget())
 		}
-
-		return blocks.NewBlockWithCid(bdata, c)
 	}
 
-	if ipld.IsNotFound(err) && fget != nil || err != nil {
-		f := fget() // Don't load the exchange until we have to
+	logger.Debug("Blockservice GetBlock: Not found")
+	return nil, ipld.ErrNotFound{Cid: c}
+}
 
-		// TODO be careful checking ErrNotFound. If the underlying
-		// implementation changes, this will break.
-		logger.Debug("Blockservice: Searching bitswap")
-		blk, err := f.GetBlock(ctx, c)
-		if err != nil {
-			return nil, err
-		}
-		cache := ctx.Value("cache")
-		if cache != nil && cache == true {
+// getBlockExchange fetches c from the network. The block is written to the
+// blockstore and announced unless the CDN is enabled, in which case it is
+// only kept if the context asks for caching.
+func (s *blockService) getBlockExchange(ctx context.Context, c cid.Cid, bs blockstore.Blockstore, f notifiableFetcher) (blocks.Block, error) {
+	// TODO be careful checking ErrNotFound. If the underlying
+	// implementation changes, this will break.
+	logger.Debug("Blockservice: Searching bitswap")
+	blk, err := f.GetBlock(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	cache := ctx.Value("cache")
+	if !s.cdnEnabled() || cache != nil && cache == true {
+		// also write in the blockstore for caching, inform the exchange that the block is available
+		if bs != nil {
 			err = bs.Put(ctx, blk)
 			if err != nil {
 				return nil, err
 			}
-			err = AddBlock(ctx, blk, false)
-			if err != nil {
-				return nil, err
-			}
-			err = f.NotifyNewBlocks(ctx, blk)
+		}
+		if s.cdnEnabled() {
+			err = s.addBlockCdn(ctx, blk)
 			if err != nil {
 				return nil, err
 			}
 		}
-		logger.Debugf("BlockService.BlockFetched %s", c)
-		return blk, nil
+		err = f.NotifyNewBlocks(ctx, blk)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	logger.Debug("Blockservice GetBlock: Not found")
-	return nil, err
+	logger.Debugf("BlockService.BlockFetched %s", c)
+	return blk, nil
 }
 
 // GetBlocks gets a list of blocks asynchronously and returns through
@@ -719,10 +713,10 @@ func (s *blockService) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan block
 		f = s.getExchange
 	}
 
-	return getBlocks(ctx, ks, s.blockstore, f) // hash security
+	return s.getBlocks(ctx, ks, s.blockstore, f) // hash security
 }
 
-func getBlocks(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) <-chan blocks.Block {
+func (s *blockService) getBlocks(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) <-chan blocks.Block {
 	out := make(chan blocks.Block)
 
 	go func() {
@@ -749,90 +743,144 @@ func getBlocks(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget
 			ks = ks2
 		}
 
-		var misses []cid.Cid
-		for _, c := range ks {
-			hit, err := getBlockCdn(ctx, c)
-			if err != nil {
-				misses = append(misses, c)
-				continue
-			}
+		send := func(blk blocks.Block) bool {
 			select {
-			case out <- hit:
+			case out <- blk:
+				return true
 			case <-ctx.Done():
-				return
+				return false
 			}
 		}
 
-		if len(misses) == 0 || fget == nil {
-			return
-		}
-
-		f := fget() // don't load exchange unless we have to
-		rblocks, err := f.GetBlocks(ctx, misses)
-		if err != nil {
-			logger.Debugf("Error with GetBlocks: %s", err)
-			return
-		}
-
-		// batch available blocks together
-		const batchSize = 32
-		batch := make([]blocks.Block, 0, batchSize)
-		for {
-			var noMoreBlocks bool
-		batchLoop:
-			for len(batch) < batchSize {
-				select {
-				case b, ok := <-rblocks:
+		misses := ks
+		for _, src := range s.lookupOrder {
+			if len(misses) == 0 {
+				return
+			}
+			switch src {
+			case SourceMemory:
+				remaining := misses[:0:0]
+				for _, c := range misses {
+					blk, ok := s.getBlockCached(ctx, c)
 					if !ok {
-						noMoreBlocks = true
-						break batchLoop
+						remaining = append(remaining, c)
+						continue
+					}
+					if !send(blk) {
+						return
 					}
+				}
+				misses = remaining
 
-					logger.Debugf("BlockService.BlockFetched %s", b.Cid())
-					batch = append(batch, b)
-				case <-ctx.Done():
+			case SourceBlockstore:
+				if bs == nil {
+					continue
+				}
+				remaining := misses[:0:0]
+				for _, c := range misses {
+					hit, err := bs.Get(ctx, c)
+					if err != nil {
+						remaining = append(remaining, c)
+						continue
+					}
+					if !send(hit) {
+						return
+					}
+				}
+				misses = remaining
+
+			case SourceCdn:
+				if !s.cdnEnabled() || s.breaker.open() {
+					continue
+				}
+				misses = s.getBlocksCdn(ctx, misses, out)
+				if ctx.Err() != nil {
 					return
-				default:
+				}
+
+			case SourceExchange:
+				if fget == nil {
+					continue
+				}
+				s.getBlocksExchange(ctx, misses, bs, fget(), out)
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// getBlocksExchange fetches ks from the network and sends them to out. Like
+// getBlockExchange, the blocks are only kept if the CDN is disabled or the
+// context asks for caching.
+func (s *blockService) getBlocksExchange(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, f notifiableFetcher, out chan<- blocks.Block) {
+	rblocks, err := f.GetBlocks(ctx, ks)
+	if err != nil {
+		logger.Debugf("Error with GetBlocks: %s", err)
+		return
+	}
+
+	// batch available blocks together
+	const batchSize = 32
+	batch := make([]blocks.Block, 0, batchSize)
+	for {
+		var noMoreBlocks bool
+	batchLoop:
+		for len(batch) < batchSize {
+			select {
+			case b, ok := <-rblocks:
+				if !ok {
+					noMoreBlocks = true
 					break batchLoop
 				}
+
+				logger.Debugf("BlockService.BlockFetched %s", b.Cid())
+				batch = append(batch, b)
+			case <-ctx.Done():
+				return
+			default:
+				break batchLoop
 			}
+		}
 
-			cache := ctx.Value("cache")
+		cache := ctx.Value("cache")
 
-			if cache != nil && cache == true {
-				// also write in the blockstore for caching, inform the exchange that the blocks are available
+		if !s.cdnEnabled() || cache != nil && cache == true {
+			// also write in the blockstore for caching, inform the exchange that the blocks are available
+			if bs != nil {
 				err = bs.PutMany(ctx, batch)
 				if err != nil {
 					logger.Errorf("could not write blocks from the network to the blockstore: %s", err)
 					return
 				}
-				_, err = AddBlocks(ctx, batch, false)
+			}
+			if s.cdnEnabled() {
+				_, err = s.addBlocksCdn(ctx, batch)
 				if err != nil {
 					logger.Errorf("could not add blocks from the network to the cdn: %s", err)
 					return
 				}
-
-				err = f.NotifyNewBlocks(ctx, batch...)
-				if err != nil {
-					logger.Errorf("could not tell the exchange about new blocks: %s", err)
-					return
-				}
 			}
 
-			for _, b := range batch {
-				select {
-				case out <- b:
-				case <-ctx.Done():
-					return
-				}
+			err = f.NotifyNewBlocks(ctx, batch...)
+			if err != nil {
+				logger.Errorf("could not tell the exchange about new blocks: %s", err)
+				return
 			}
-			batch = batch[:0]
-			if noMoreBlocks {
-				break
+		}
+
+		for _, b := range batch {
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
 			}
 		}
-	}()
-	return out
+		batch = batch[:0]
+		if noMoreBlocks {
+			break
+		}
+	}
 }
 
 // DeleteBlock deletes a block in the blockservice from the datastore
@@ -840,6 +888,19 @@ func (s *blockService) DeleteBlock(ctx context.Context, c cid.Cid) error {
 	ctx, span := internal.StartSpan(ctx, "blockService.DeleteBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
 	defer span.End()
 
+	if s.cache != nil {
+		s.cache.Remove(c)
+	}
+	s.buffer.remove(c)
+	if s.cdnEnabled() {
+		if err := s.deleteBlockCdn(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	if s.blockstore == nil {
+		return nil
+	}
 	err := s.blockstore.DeleteBlock(ctx, c)
 	if err == nil {
 		logger.Debugf("BlockService.BlockDeleted %s", c)
@@ -848,8 +909,33 @@ func (s *blockService) DeleteBlock(ctx context.Context, c cid.Cid) error {
 }
 
 func (s *blockService) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
+
+func (s *blockService) close() error {
 	logger.Debug("blockservice is shutting down...")
-	return s.exchange.Close()
+	var err error
+	if s.stop != nil {
+		close(s.stop)
+		s.workers.Wait()
+	}
+	if s.buffer != nil {
+		if err = s.buffer.close(); err != nil {
+			logger.Errorf("could not write buffered blocks: %s", err)
+		}
+	}
+	if s.bandwidth != nil {
+		s.bandwidth.close()
+	}
+	if s.exchange != nil {
+		if cerr := s.exchange.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
 type notifier interface {
@@ -858,6 +944,7 @@ type notifier interface {
 
 // Session is a helper type to provide higher level access to bitswap sessions
 type Session struct {
+	bserv    *blockService
 	bs       blockstore.Blockstore
 	ses      exchange.Fetcher
 	sessEx   exchange.SessionExchange
@@ -900,61 +987,14 @@ func (s *Session) getFetcherFactory() func() notifiableFetcher {
 	}
 	return nil
 }
-func getBlockCdn(ctx context.Context, c cid.Cid) (blocks.Block, error) {
-	kv1, err := rdb.Get(ctx, c.Hash().HexString()).Bytes()
-	if err == nil {
-		var f fileInfo
-
-		err := json.Unmarshal(kv1, &f)
-		if err != nil {
-			return nil, err
-		}
-
-		endpoint, err := url.Parse(fmt.Sprintf("%s/cacheFile/%s", uploader, f.FileRecordID))
-		if err != nil {
-			return nil, err
-		}
-
-		rawQuery := endpoint.Query()
-		rawQuery.Set("range", fmt.Sprintf("%d,%d", f.Offset, f.Size))
-		endpoint.RawQuery = rawQuery.Encode()
-		fileUrl := endpoint.String()
-
-		resp, err := http.Get(fileUrl)
-		if err != nil {
-			return nil, err
-		}
-		hash, err := internal.GetHashStringFromCid(c.String())
-		if err != nil {
-			logger.Debugf("GetHashFromCidString Error %v", err)
-		}
-		if isDedicatedGateway {
-			addBandwidthUsage(f.Size, hash)
-		}
 
-		bdata, err := io.ReadAll(resp.Body)
-		if err == nil {
-			return blocks.NewBlockWithCid(bdata, c)
-		}
+// addBandwidthUsage accounts fileSize bytes served for the block whose
+// multihash is hash. It is reported to the pinning service in the background.
+func (s *blockService) addBandwidthUsage(fileSize uint64, hash string) {
+	if s.bandwidth == nil {
+		return
 	}
-	return nil, err
-}
-func addBandwidthUsage(fileSize uint64, hash string) error {
-	apiUrl := fmt.Sprintf("%s/api/hourlyUsage/bandwidth/", pinningService)
-	reqBody, _ := json.Marshal(map[string]interface{}{
-		"amount": fileSize,
-		"cid":    hash,
-	})
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", apiUrl, bytes.NewBuffer(reqBody))
-	req.Header.Set("blockservice-API-Key", apiKey)
-	req.Header.Set("Content-Type", "application/json")
-	_, err := client.Do(req)
-	if err != nil {
-		logger.Debugf("Failed to send Bandwidth Usage Error %v", err)
-		return err
-	}
-	return nil
+	s.bandwidth.add(hash, fileSize)
 }
 
 // GetBlock gets a block in the context of a request session
@@ -962,7 +1002,7 @@ func (s *Session) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error)
 	ctx, span := internal.StartSpan(ctx, "Session.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
 	defer span.End()
 
-	return getBlock(ctx, c, s.bs, s.getFetcherFactory()) // hash security
+	return s.bserv.getBlock(ctx, c, s.bs, s.getFetcherFactory()) // hash security
 }
 
 // GetBlocks gets blocks in the context of a request session
@@ -970,7 +1010,7 @@ func (s *Session) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan blocks.Blo
 	ctx, span := internal.StartSpan(ctx, "Session.GetBlocks")
 	defer span.End()
 
-	return getBlocks(ctx, ks, s.bs, s.getFetcherFactory()) // hash security
+	return s.bserv.getBlocks(ctx, ks, s.bs, s.getFetcherFactory()) // hash security
 }
 
 var _ BlockGetter = (*Session)(nil)
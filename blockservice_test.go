@@ -1,8 +1,13 @@
 package blockservice
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
@@ -13,6 +18,9 @@ import (
 	exchange "github.com/ipfs/go-ipfs-exchange-interface"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	ipld "github.com/ipfs/go-ipld-format"
+
+	"github.com/ipfs/go-blockservice/pinning"
+	"github.com/ipfs/go-blockservice/uploader"
 )
 
 func TestWriteThroughWorks(t *testing.T) {
@@ -241,3 +249,626 @@ func TestNilExchange(t *testing.T) {
 		t.Fatal("got the wrong block")
 	}
 }
+
+func TestOptionsArePerInstance(t *testing.T) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	staging := New(bs, nil, WithUploader("http://staging"), WithPinningService("http://pin-staging", "k1"))
+	production := New(bs, nil, WithUploader("http://production"), WithDedicatedGateway(true))
+
+	if u, _ := staging.(*blockService).GetUploader(); u != "http://staging" {
+		t.Fatalf("unexpected staging uploader %q", u)
+	}
+	if u, _ := production.(*blockService).GetUploader(); u != "http://production" {
+		t.Fatalf("unexpected production uploader %q", u)
+	}
+	if staging.(*blockService).isDedicatedGateway {
+		t.Fatal("dedicated gateway option leaked across instances")
+	}
+
+	sess := NewSession(context.Background(), staging)
+	if sess.bserv != staging {
+		t.Fatal("session should share the configuration of its blockservice")
+	}
+}
+
+func newCdnBlockService(t *testing.T, opts ...Option) (BlockService, *uploader.Mock, BlockIndex) {
+	t.Helper()
+	up := uploader.NewMock()
+	idx := NewMemoryIndex()
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	opts = append([]Option{WithUploaderClient(up), WithIndex(idx)}, opts...)
+	return New(bs, nil, opts...), up, idx
+}
+
+func TestCdnWithoutBlockstore(t *testing.T) {
+	ctx := context.Background()
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(nil, offline.Exchange(exchbstore), WithUploaderClient(uploader.NewMock()), WithIndex(NewMemoryIndex()))
+	bgen := butil.NewBlockGenerator()
+
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSession(ctx, bserv).GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	// Blocks from the exchange are cached in the CDN only.
+	remote := bgen.Next()
+	if err := exchbstore.Put(ctx, remote); err != nil {
+		t.Fatal(err)
+	}
+	cached := context.WithValue(ctx, "cache", true)
+	if _, err := bserv.GetBlock(cached, remote.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range bserv.GetBlocks(cached, []cid.Cid{block.Cid(), remote.Cid()}) {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 blocks, got %d", n)
+	}
+	if err := bserv.DeleteBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCdnRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	bserv, up, _ := newCdnBlockService(t)
+	bgen := butil.NewBlockGenerator()
+
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bserv.Blockstore().Has(ctx, block.Cid()); has {
+		t.Fatal("CDN backed blocks should not be written to the blockstore")
+	}
+	got, err := bserv.GetBlock(ctx, block.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.RawData(), block.RawData()) {
+		t.Fatal("block data is not equal")
+	}
+
+	many := []blocks.Block{bgen.Next(), bgen.Next(), bgen.Next()}
+	if err := bserv.AddBlocks(ctx, many); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 2 {
+		t.Fatalf("expected one upload per add without a user, got %d", up.Uploads)
+	}
+	var ks []cid.Cid
+	for _, b := range many {
+		ks = append(ks, b.Cid())
+	}
+	n := 0
+	for b := range bserv.GetBlocks(ctx, ks) {
+		if !bytes.Equal(b.RawData(), many[indexOfCid(many, b.Cid())].RawData()) {
+			t.Fatalf("block data of %s is not equal", b.Cid())
+		}
+		n++
+	}
+	if n != len(many) {
+		t.Fatalf("expected %d blocks, got %d", len(many), n)
+	}
+}
+
+func indexOfCid(bs []blocks.Block, c cid.Cid) int {
+	for i, b := range bs {
+		if b.Cid().Equals(c) {
+			return i
+		}
+	}
+	return -1
+}
+
+var _ pinning.Client = (*recordingPinning)(nil)
+
+type recordingPinning struct {
+	lk        sync.Mutex
+	records   map[string]uint64
+	bandwidth map[string]uint64
+}
+
+func newRecordingPinning() *recordingPinning {
+	return &recordingPinning{
+		records:   make(map[string]uint64),
+		bandwidth: make(map[string]uint64),
+	}
+}
+
+func (p *recordingPinning) CreateFileRecord(ctx context.Context, userID, fileRecordID string, size uint64) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.records[userID+"/"+fileRecordID] = size
+	return nil
+}
+
+func (p *recordingPinning) ReportBandwidth(ctx context.Context, cid string, amount uint64) error {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	p.bandwidth[cid] += amount
+	return nil
+}
+
+func TestPinningAccounting(t *testing.T) {
+	pin := newRecordingPinning()
+	bserv, _, idx := newCdnBlockService(t, WithPinningClient(pin), WithDedicatedGateway(true))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	if err := idx.Put(ctx, userKey("alice"), []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(len(block.RawData()))
+	if pin.records["alice/pack-1"] != size {
+		t.Fatalf("expected a %d bytes file record for alice, got %v", size, pin.records)
+	}
+
+	if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	// The bandwidth is reported in the background, at the latest on Close.
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pin.bandwidth[block.Cid().Hash().HexString()] != size {
+		t.Fatalf("expected %d bytes of bandwidth, got %v", size, pin.bandwidth)
+	}
+}
+
+func TestUploadTempDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	bserv, _, _ := newCdnBlockService(t, WithTempDir(dir))
+	bgen := butil.NewBlockGenerator()
+
+	bs := []blocks.Block{bgen.Next(), bgen.Next()}
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs {
+		got, err := bserv.GetBlock(ctx, b.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.RawData(), b.RawData()) {
+			t.Fatal("block data is not equal")
+		}
+	}
+
+	left, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Fatalf("expected temporary files to be removed, found %d", len(left))
+	}
+}
+
+func TestCdnHashMismatchFallsBackToExchange(t *testing.T) {
+	ctx := context.Background()
+	up := uploader.NewMock()
+	idx := NewMemoryIndex()
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		offline.Exchange(exchbstore),
+		WithUploaderClient(up), WithIndex(idx), WithInvalidateOnMismatch(true),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := exchbstore.Put(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	up.Corrupt("pack-1", 0, []byte("garbage"))
+
+	_, _, err := bserv.(*blockService).fetchBlockCdn(ctx, block.Cid())
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+	if _, err := idx.Get(ctx, blockKey(block.Cid().Hash())); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the index entry to be invalidated, got %v", err)
+	}
+
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	up.Corrupt("pack-2", 0, []byte("garbage"))
+	got, err := bserv.GetBlock(ctx, block.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.RawData(), block.RawData()) {
+		t.Fatal("expected the block to be served by the exchange")
+	}
+}
+
+var _ BlockIndex = (*countingIndex)(nil)
+
+type countingIndex struct {
+	BlockIndex
+	lk        sync.Mutex
+	gets      int
+	batchGets int
+}
+
+func (ci *countingIndex) Get(ctx context.Context, key string) ([]byte, error) {
+	ci.lk.Lock()
+	ci.gets++
+	ci.lk.Unlock()
+	return ci.BlockIndex.Get(ctx, key)
+}
+
+func (ci *countingIndex) BatchGet(ctx context.Context, keys []string) ([][]byte, error) {
+	ci.lk.Lock()
+	ci.batchGets++
+	ci.lk.Unlock()
+	return ci.BlockIndex.BatchGet(ctx, keys)
+}
+
+func TestGetBlocksBatchesIndexLookups(t *testing.T) {
+	ctx := context.Background()
+	idx := &countingIndex{BlockIndex: NewMemoryIndex()}
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(uploader.NewMock()), WithIndex(idx), WithFetchConcurrency(4),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	var (
+		bs []blocks.Block
+		ks []cid.Cid
+	)
+	for i := 0; i < 100; i++ {
+		b := bgen.Next()
+		bs = append(bs, b)
+		ks = append(ks, b.Cid())
+	}
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+	// One block is not indexed and has to be reported as a miss.
+	ks = append(ks, bgen.Next().Cid())
+
+	idx.gets, idx.batchGets = 0, 0
+	n := 0
+	for b := range bserv.GetBlocks(ctx, ks) {
+		if !bytes.Equal(b.RawData(), bs[indexOfCid(bs, b.Cid())].RawData()) {
+			t.Fatalf("block data of %s is not equal", b.Cid())
+		}
+		n++
+	}
+	if n != len(bs) {
+		t.Fatalf("expected %d blocks, got %d", len(bs), n)
+	}
+	if idx.gets != 0 || idx.batchGets != 1 {
+		t.Fatalf("expected a single batched lookup, got %d gets and %d batch gets", idx.gets, idx.batchGets)
+	}
+}
+
+func TestAddBlockFirstUpload(t *testing.T) {
+	bserv, up, idx := newCdnBlockService(t)
+	ctx := context.WithValue(context.Background(), "userID", "bob")
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 1 {
+		t.Fatalf("expected the block to be uploaded, got %d uploads", up.Uploads)
+	}
+	fr, err := bserv.(*blockService).getFileRecord(ctx, "bob")
+	if err != nil {
+		t.Fatalf("expected a file record to be created: %s", err)
+	}
+	if fr.FileRecordID != "pack-1" || fr.Size != uint64(len(block.RawData())) {
+		t.Fatalf("unexpected file record %+v", fr)
+	}
+	if _, err := idx.Get(ctx, blockKey(block.Cid().Hash())); err != nil {
+		t.Fatalf("expected the block to be indexed: %s", err)
+	}
+}
+
+var _ BlockIndex = (*failingIndex)(nil)
+
+type failingIndex struct {
+	BlockIndex
+	err error
+}
+
+func (fi *failingIndex) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, fi.err
+}
+
+func (fi *failingIndex) BatchGet(ctx context.Context, keys []string) ([][]byte, error) {
+	return nil, fi.err
+}
+
+func TestAddBlockIndexUnavailable(t *testing.T) {
+	idx := &failingIndex{NewMemoryIndex(), errors.New("connection refused")}
+	bserv, up, _ := newCdnBlockService(t, WithIndex(idx))
+	bgen := butil.NewBlockGenerator()
+
+	for _, userID := range []string{"", "bob"} {
+		ctx := context.WithValue(context.Background(), "userID", userID)
+		if err := bserv.AddBlock(ctx, bgen.Next()); !errors.Is(err, ErrIndexUnavailable) {
+			t.Fatalf("AddBlock: expected ErrIndexUnavailable, got %v", err)
+		}
+		if err := bserv.AddBlocks(ctx, []blocks.Block{bgen.Next()}); !errors.Is(err, ErrIndexUnavailable) {
+			t.Fatalf("AddBlocks: expected ErrIndexUnavailable, got %v", err)
+		}
+	}
+	if up.Uploads != 0 {
+		t.Fatalf("expected no upload without an index, got %d", up.Uploads)
+	}
+}
+
+type failingUploader struct {
+	uploader.Client
+	err error
+}
+
+func (fu *failingUploader) Upload(ctx context.Context, parts []uploader.Part) (*uploader.PackResponse, error) {
+	return nil, fu.err
+}
+
+func TestAddBlockUploaderErrors(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind error
+	}{
+		{errors.New("dial tcp: connection refused"), ErrUploaderUnavailable},
+		{&uploader.StatusError{Op: "packUpload", StatusCode: 503}, ErrUploaderUnavailable},
+		{&uploader.StatusError{Op: "packUpload", StatusCode: 500}, ErrUploaderUnavailable},
+		{&uploader.StatusError{Op: "packUpload", StatusCode: 408}, ErrUploaderUnavailable},
+		{&uploader.StatusError{Op: "packUpload", StatusCode: 413}, ErrUploadRejected},
+	}
+	bgen := butil.NewBlockGenerator()
+	for _, tc := range cases {
+		bserv, _, _ := newCdnBlockService(t, WithUploaderClient(&failingUploader{uploader.NewMock(), tc.err}))
+		err := bserv.AddBlock(context.Background(), bgen.Next())
+		if !errors.Is(err, tc.kind) || !errors.Is(err, tc.err) {
+			t.Fatalf("%v: expected %v, got %v", tc.err, tc.kind, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bserv, _, _ := newCdnBlockService(t, WithUploaderClient(&failingUploader{uploader.NewMock(), ctx.Err()}))
+	err := bserv.AddBlock(ctx, bgen.Next())
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrUploaderUnavailable) {
+		t.Fatalf("expected a plain context error, got %v", err)
+	}
+}
+
+// slowUploader widens the window between reading and updating the record of
+// a user.
+type slowUploader struct {
+	*uploader.Mock
+}
+
+func (su slowUploader) Upload(ctx context.Context, parts []uploader.Part) (*uploader.PackResponse, error) {
+	time.Sleep(time.Millisecond)
+	return su.Mock.Upload(ctx, parts)
+}
+
+func (su slowUploader) Append(ctx context.Context, fileRecordID string, parts []uploader.Part) (*uploader.ZipReader, error) {
+	time.Sleep(time.Millisecond)
+	return su.Mock.Append(ctx, fileRecordID, parts)
+}
+
+func TestConcurrentAddBlocksSameUser(t *testing.T) {
+	up := uploader.NewMock()
+	bserv, _, _ := newCdnBlockService(t, WithUploaderClient(slowUploader{up}))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+
+	const (
+		writers = 16
+		adds    = 10
+	)
+	bgen := butil.NewBlockGenerator()
+	batches := make([][]blocks.Block, writers*adds)
+	var total uint64
+	for i := range batches {
+		batches[i] = []blocks.Block{bgen.Next(), bgen.Next(), bgen.Next()}
+		for _, b := range batches[i] {
+			total += uint64(len(b.RawData()))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < adds; i++ {
+				if err := bserv.AddBlocks(ctx, batches[w*adds+i]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if up.Uploads != 1 {
+		t.Fatalf("expected a single pack for the user, got %d uploads", up.Uploads)
+	}
+	fr, err := bserv.(*blockService).getFileRecord(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.FileRecordID != "pack-1" || fr.Size != total {
+		t.Fatalf("expected record of pack-1 with %d bytes, got %+v", total, fr)
+	}
+	for _, batch := range batches {
+		for _, b := range batch {
+			got, err := bserv.GetBlock(ctx, b.Cid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.RawData(), b.RawData()) {
+				t.Fatalf("block data of %s is not equal", b.Cid())
+			}
+		}
+	}
+}
+
+// unavailableAppender fails all appends with status, as if the uploader was
+// down.
+type unavailableAppender struct {
+	*uploader.Mock
+	status int
+}
+
+func (ua unavailableAppender) Append(ctx context.Context, fileRecordID string, parts []uploader.Part) (*uploader.ZipReader, error) {
+	return nil, &uploader.StatusError{Op: "zipAction", StatusCode: ua.status}
+}
+
+func TestAppendFailureKeepsPack(t *testing.T) {
+	for _, status := range []int{503, 408} {
+		up := uploader.NewMock()
+		bserv, _, _ := newCdnBlockService(t, WithUploaderClient(unavailableAppender{up, status}))
+		ctx := context.WithValue(context.Background(), "userID", "alice")
+		bgen := butil.NewBlockGenerator()
+
+		if err := bserv.AddBlock(ctx, bgen.Next()); err != nil {
+			t.Fatal(err)
+		}
+		if err := bserv.AddBlock(ctx, bgen.Next()); !errors.Is(err, ErrUploaderUnavailable) {
+			t.Fatalf("%d: expected ErrUploaderUnavailable, got %v", status, err)
+		}
+		if up.Uploads != 1 {
+			t.Fatalf("%d: expected a transient append failure not to start a new pack, got %d uploads", status, up.Uploads)
+		}
+	}
+}
+
+func TestGetBlockOfflineNotFound(t *testing.T) {
+	ctx := context.Background()
+	bserv, _, _ := newCdnBlockService(t)
+	bgen := butil.NewBlockGenerator()
+	c := bgen.Next().Cid()
+
+	if _, err := bserv.GetBlock(ctx, c); !ipld.IsNotFound(err) {
+		t.Fatalf("expected ipld.ErrNotFound, got %v", err)
+	}
+	for range bserv.GetBlocks(ctx, []cid.Cid{c}) {
+		t.Fatal("expected no block")
+	}
+}
+
+func TestLookupOrder(t *testing.T) {
+	ctx := context.Background()
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+
+	bserv, up, _ := newCdnBlockService(t)
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.Blockstore().Put(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if up.Reads != 0 {
+		t.Fatalf("expected the blockstore to be consulted before the CDN, got %d reads", up.Reads)
+	}
+
+	cdnFirst := New(bserv.Blockstore(), nil, WithUploaderClient(up), WithIndex(bserv.(*blockService).index),
+		WithLookupOrder(SourceCdn, SourceBlockstore))
+	if _, err := cdnFirst.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if up.Reads != 1 {
+		t.Fatalf("expected the CDN to be read first, got %d reads", up.Reads)
+	}
+
+	local := bgen.Next()
+	if err := bserv.Blockstore().Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	cdnOnly := New(bserv.Blockstore(), nil, WithUploaderClient(up), WithIndex(bserv.(*blockService).index),
+		WithLookupOrder(SourceCdn))
+	if _, err := cdnOnly.GetBlock(ctx, local.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected sources left out not to be read, got %v", err)
+	}
+	n := 0
+	for range cdnOnly.GetBlocks(ctx, []cid.Cid{block.Cid(), local.Cid()}) {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected only the CDN block, got %d blocks", n)
+	}
+}
+
+func TestDeleteBlockTracksGarbage(t *testing.T) {
+	pin := newRecordingPinning()
+	bserv, _, idx := newCdnBlockService(t, WithPinningClient(pin))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	a, b := bgen.Next(), bgen.Next()
+	if err := bserv.AddBlocks(ctx, []blocks.Block{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	total := uint64(len(a.RawData()) + len(b.RawData()))
+	if pin.records["alice/pack-1"] != total {
+		t.Fatalf("expected a %d bytes file record, got %v", total, pin.records)
+	}
+
+	if err := bserv.DeleteBlock(ctx, a.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Get(ctx, blockKey(a.Cid().Hash())); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the index entry to be removed, got %v", err)
+	}
+	if _, err := bserv.GetBlock(ctx, a.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected ipld.ErrNotFound, got %v", err)
+	}
+	if _, err := bserv.GetBlock(ctx, b.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := bserv.(*blockService).getPackGarbage(ctx, "pack-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(len(a.RawData()))
+	if g.Bytes != size || len(g.Ranges) != 1 || g.Ranges[0].Size != size {
+		t.Fatalf("expected %d bytes of garbage, got %+v", size, g)
+	}
+	if pin.records["alice/pack-1"] != total-size {
+		t.Fatalf("expected alice to be accounted %d bytes, got %v", total-size, pin.records)
+	}
+
+	// Deleting again is a no-op.
+	if err := bserv.DeleteBlock(ctx, a.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if g, _ := bserv.(*blockService).getPackGarbage(ctx, "pack-1"); g.Bytes != size {
+		t.Fatalf("expected garbage to be recorded once, got %+v", g)
+	}
+}
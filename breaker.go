@@ -0,0 +1,206 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+// ErrCircuitOpen is returned for CDN reads skipped because the circuit
+// breaker of the uploader is open.
+var ErrCircuitOpen = errors.New("blockservice: uploader circuit breaker open")
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all the reads through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen sends reads to the blockstore and the exchange.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe read through to decide whether to
+	// close the breaker again.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Defaults for the zero fields of BreakerOptions.
+const (
+	defaultBreakerFailures    = 5
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+// BreakerOptions configures a CircuitBreaker.
+type BreakerOptions struct {
+	// Failures is the number of consecutive failed reads tripping the
+	// breaker. It defaults to 5.
+	Failures int
+	// SlowThreshold counts reads taking longer as failures. Zero disables
+	// latency tracking.
+	SlowThreshold time.Duration
+	// OpenTimeout is how long the breaker stays open before letting a probe
+	// through. It defaults to 30s.
+	OpenTimeout time.Duration
+}
+
+// BreakerStats is a snapshot of a CircuitBreaker, for health checks.
+type BreakerStats struct {
+	State BreakerState
+	// ConsecutiveFailures is the number of failed reads since the last
+	// successful one.
+	ConsecutiveFailures int
+	// OpenedAt is when the breaker last tripped.
+	OpenedAt time.Time
+}
+
+// CircuitBreaker stops sending reads to an uploader that keeps failing or
+// answering slowly, and serves them from the blockstore and the exchange
+// instead. It should be shared by the blockservices using the same uploader.
+type CircuitBreaker struct {
+	opts BreakerOptions
+
+	lk       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker.
+func NewCircuitBreaker(opts BreakerOptions) *CircuitBreaker {
+	if opts.Failures <= 0 {
+		opts.Failures = defaultBreakerFailures
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	return &CircuitBreaker{opts: opts}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	return b.Stats().State
+}
+
+// Stats returns a snapshot of the breaker.
+func (b *CircuitBreaker) Stats() BreakerStats {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return BreakerStats{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		OpenedAt:            b.openedAt,
+	}
+}
+
+// open reports whether reads should skip the CDN. An open breaker whose
+// timeout elapsed is not, so that the next read probes the uploader. It is
+// safe to call on a nil breaker.
+func (b *CircuitBreaker) open() bool {
+	if b == nil {
+		return false
+	}
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.state == BreakerOpen && time.Since(b.openedAt) < b.opts.OpenTimeout
+}
+
+// allow reports whether a read may be sent to the uploader. Every allowed
+// read must be followed by a call to done.
+func (b *CircuitBreaker) allow() bool {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.opts.OpenTimeout {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// done records the outcome of an allowed read.
+func (b *CircuitBreaker) done(ctx context.Context, err error, latency time.Duration) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// Abandoned by the caller, this says nothing about the uploader. A
+		// read that ran out of time, on the contrary, failed.
+		if b.state == BreakerHalfOpen {
+			b.probing = false
+		}
+		return
+	}
+	// Missing ranges are answered quickly by a healthy uploader.
+	failed := err != nil && !errors.Is(err, uploader.ErrNotFound) ||
+		b.opts.SlowThreshold > 0 && latency > b.opts.SlowThreshold
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.tripLocked()
+			return
+		}
+		b.state = BreakerClosed
+		b.failures = 0
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.opts.Failures {
+			b.tripLocked()
+		}
+	}
+}
+
+func (b *CircuitBreaker) tripLocked() {
+	if b.state != BreakerOpen {
+		logger.Errorf("uploader circuit breaker open after %d failed reads", b.failures)
+	}
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+}
+
+// readRange reads a range of a pack from the CDN through the circuit breaker,
+// if any.
+func (s *blockService) readRange(ctx context.Context, fileRecordID string, offset, size uint64) ([]byte, error) {
+	if s.breaker == nil {
+		return s.uploaderClient.ReadRange(ctx, fileRecordID, offset, size)
+	}
+	if !s.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+	start := time.Now()
+	data, err := s.uploaderClient.ReadRange(ctx, fileRecordID, offset, size)
+	s.breaker.done(ctx, err, time.Since(start))
+	return data, err
+}
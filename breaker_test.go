@@ -0,0 +1,131 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	ctx := context.Background()
+	b := NewCircuitBreaker(BreakerOptions{Failures: 2, SlowThreshold: time.Second, OpenTimeout: 20 * time.Millisecond})
+	failure := &uploader.StatusError{StatusCode: http.StatusBadGateway}
+
+	for _, err := range []error{failure, &uploader.StatusError{StatusCode: http.StatusNotFound}, failure} {
+		if !b.allow() {
+			t.Fatal("expected a closed breaker to allow reads")
+		}
+		b.done(ctx, err, 0)
+	}
+	if b.State() != BreakerClosed {
+		t.Fatal("expected missing ranges to reset the failure count")
+	}
+	b.allow()
+	b.done(ctx, nil, 2*time.Second)
+	if st := b.Stats(); st.State != BreakerOpen || st.ConsecutiveFailures != 2 || st.OpenedAt.IsZero() {
+		t.Fatalf("expected a slow read to trip the breaker, got %+v", st)
+	}
+	if !b.open() || b.allow() {
+		t.Fatal("expected an open breaker to refuse reads")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if b.open() || !b.allow() {
+		t.Fatal("expected a probe to be let through after the timeout")
+	}
+	if b.State() != BreakerHalfOpen || b.allow() {
+		t.Fatal("expected a single probe at a time")
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	b.done(cctx, cctx.Err(), 0)
+	if b.State() != BreakerHalfOpen || !b.allow() {
+		t.Fatal("expected an abandoned probe to be replaced")
+	}
+	b.done(ctx, failure, 0)
+	if b.State() != BreakerOpen {
+		t.Fatal("expected a failed probe to open the breaker again")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	b.allow()
+	b.done(ctx, nil, 0)
+	if st := b.Stats(); st.State != BreakerClosed || st.ConsecutiveFailures != 0 {
+		t.Fatalf("expected a successful probe to close the breaker, got %+v", st)
+	}
+}
+
+// brokenReader fails all the range reads.
+type brokenReader struct {
+	*uploader.Mock
+	lk    sync.Mutex
+	reads int
+}
+
+func (br *brokenReader) ReadRange(ctx context.Context, fileRecordID string, offset, size uint64) ([]byte, error) {
+	br.lk.Lock()
+	br.reads++
+	br.lk.Unlock()
+	return nil, &uploader.StatusError{Op: "cacheFile", StatusCode: http.StatusBadGateway}
+}
+
+func TestGetBlockCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	up := &brokenReader{Mock: uploader.NewMock()}
+	breaker := NewCircuitBreaker(BreakerOptions{Failures: 2, OpenTimeout: time.Hour})
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		offline.Exchange(exchbstore),
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()), WithCircuitBreaker(breaker),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if err := exchbstore.Put(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed CDN reads fall back to the exchange.
+	for i := 0; i < 2; i++ {
+		if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+			t.Fatalf("expected the block to be fetched from the exchange, got %v", err)
+		}
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("expected the breaker to be open, got %s", breaker.State())
+	}
+
+	got, err := bserv.GetBlock(ctx, block.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.RawData(), block.RawData()) {
+		t.Fatal("block data is not equal")
+	}
+	n := 0
+	for range bserv.GetBlocks(ctx, []cid.Cid{block.Cid()}) {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected GetBlocks to fall back to the exchange, got %d blocks", n)
+	}
+	if up.reads != 2 {
+		t.Fatalf("expected reads to skip the CDN while open, got %d reads", up.reads)
+	}
+}
@@ -0,0 +1,344 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+
+	"github.com/ipfs/go-blockservice/retry"
+)
+
+// writeBuffer aggregates the blocks added by each user in memory, and writes
+// them to the CDN in batches once they reach a size or an age. Buffered blocks
+// are served from memory until they are written.
+//
+// Batches that fail to be written stay buffered and are retried after
+// maxDelay. Once the buffered blocks total maxTotal bytes, adds are refused
+// and written directly by their caller instead.
+type writeBuffer struct {
+	maxBytes uint64
+	maxTotal uint64
+	maxDelay time.Duration
+	// policy controls how the blocks left when closing are retried.
+	policy retry.Policy
+	flush  func(ctx context.Context, userID string, bs []blocks.Block) error
+
+	lk     sync.Mutex
+	users  map[string]*userBuffer
+	blocks map[string]*bufferedBlock
+	// size is the number of bytes of blocks.
+	size   uint64
+	timers sync.WaitGroup
+	closed bool
+}
+
+// userBuffer holds the blocks of a user waiting to be written. keys covers
+// both the pending blocks and the ones being written.
+type userBuffer struct {
+	pending []blocks.Block
+	size    uint64
+	keys    map[string]struct{}
+	timer   *time.Timer
+}
+
+// bufferedBlock is a block buffered for refs users.
+type bufferedBlock struct {
+	blk  blocks.Block
+	refs int
+}
+
+func newWriteBuffer(maxBytes, maxTotal uint64, maxDelay time.Duration, policy retry.Policy, flush func(context.Context, string, []blocks.Block) error) *writeBuffer {
+	return &writeBuffer{
+		maxBytes: maxBytes,
+		maxTotal: maxTotal,
+		maxDelay: maxDelay,
+		policy:   policy,
+		flush:    flush,
+		users:    make(map[string]*userBuffer),
+		blocks:   make(map[string]*bufferedBlock),
+	}
+}
+
+// add buffers bs for userID and returns the blocks that were not already
+// buffered for that user. If the buffer of the user is full, it is written
+// before add returns. A failure to write it is not reported, the blocks stay
+// buffered and are written again later.
+func (w *writeBuffer) add(ctx context.Context, userID string, bs []blocks.Block) ([]blocks.Block, error) {
+	w.lk.Lock()
+	if w.closed {
+		w.lk.Unlock()
+		return nil, errBufferClosed
+	}
+	if w.maxTotal > 0 && w.size > 0 && w.size+w.newBytesLocked(bs) > w.maxTotal {
+		w.lk.Unlock()
+		return nil, errBufferFull
+	}
+	ub, ok := w.users[userID]
+	if !ok {
+		ub = &userBuffer{keys: make(map[string]struct{})}
+		w.users[userID] = ub
+	}
+	added := make([]blocks.Block, 0, len(bs))
+	for _, b := range bs {
+		key := blockKey(b.Cid().Hash())
+		if _, ok := ub.keys[key]; ok {
+			continue
+		}
+		ub.keys[key] = struct{}{}
+		ub.pending = append(ub.pending, b)
+		ub.size += uint64(len(b.RawData()))
+		if bb, ok := w.blocks[key]; ok {
+			bb.refs++
+		} else {
+			w.blocks[key] = &bufferedBlock{blk: b, refs: 1}
+			w.size += uint64(len(b.RawData()))
+		}
+		added = append(added, b)
+	}
+
+	if ub.size < w.maxBytes {
+		w.scheduleLocked(userID, ub)
+		w.lk.Unlock()
+		return added, nil
+	}
+	batch := w.takeLocked(ub)
+	w.lk.Unlock()
+	if err := w.write(ctx, userID, batch); err != nil {
+		logger.Errorf("could not write %d buffered blocks of user %q: %s", len(batch), userID, err)
+	}
+	return added, nil
+}
+
+// newBytesLocked returns the number of bytes adding bs would buffer.
+func (w *writeBuffer) newBytesLocked(bs []blocks.Block) uint64 {
+	var n uint64
+	for _, b := range bs {
+		if _, ok := w.blocks[blockKey(b.Cid().Hash())]; !ok {
+			n += uint64(len(b.RawData()))
+		}
+	}
+	return n
+}
+
+var (
+	// errBufferClosed is returned by add once the buffer is closed, in
+	// which case blocks are written directly.
+	errBufferClosed = errors.New("blockservice: write buffer closed")
+	// errBufferFull is returned by add when the buffer holds too many
+	// bytes, in which case blocks are written directly, which slows the
+	// writer down to the pace of the CDN.
+	errBufferFull = errors.New("blockservice: write buffer full")
+)
+
+// scheduleLocked arms the timer writing the blocks of ub after maxDelay.
+func (w *writeBuffer) scheduleLocked(userID string, ub *userBuffer) {
+	if ub.timer != nil || len(ub.pending) == 0 || w.maxDelay <= 0 || w.closed {
+		return
+	}
+	w.timers.Add(1)
+	var t *time.Timer
+	t = time.AfterFunc(w.maxDelay, func() {
+		defer w.timers.Done()
+		w.lk.Lock()
+		if ub.timer == t {
+			ub.timer = nil
+		}
+		batch := w.takeLocked(ub)
+		w.lk.Unlock()
+
+		ctx := context.Background()
+		if userID != "" {
+			ctx = context.WithValue(ctx, "userID", userID)
+		}
+		if err := w.write(ctx, userID, batch); err != nil {
+			logger.Errorf("could not write %d buffered blocks of user %q: %s", len(batch), userID, err)
+		}
+	})
+	ub.timer = t
+}
+
+// takeLocked removes the pending blocks of ub, which stay readable until
+// they are written.
+func (w *writeBuffer) takeLocked(ub *userBuffer) []blocks.Block {
+	w.stopTimerLocked(ub)
+	batch := ub.pending
+	ub.pending = nil
+	ub.size = 0
+	return batch
+}
+
+// stopTimerLocked disarms the timer of ub, if it has not fired yet.
+func (w *writeBuffer) stopTimerLocked(ub *userBuffer) {
+	if ub.timer != nil && ub.timer.Stop() {
+		w.timers.Done()
+	}
+	ub.timer = nil
+}
+
+// write writes batch and forgets its blocks, or puts them back in the buffer
+// of userID if it fails.
+func (w *writeBuffer) write(ctx context.Context, userID string, batch []blocks.Block) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	err := w.flush(ctx, userID, batch)
+
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	ub := w.users[userID]
+	if err != nil {
+		var retry []blocks.Block
+		for _, b := range batch {
+			if ub == nil {
+				break
+			}
+			// Blocks removed while being written are dropped.
+			if _, ok := ub.keys[blockKey(b.Cid().Hash())]; ok {
+				retry = append(retry, b)
+				ub.size += uint64(len(b.RawData()))
+			}
+		}
+		if len(retry) != 0 {
+			ub.pending = append(retry, ub.pending...)
+			w.scheduleLocked(userID, ub)
+		}
+		return err
+	}
+	if ub == nil {
+		return nil
+	}
+	for _, b := range batch {
+		key := blockKey(b.Cid().Hash())
+		if _, ok := ub.keys[key]; !ok {
+			continue
+		}
+		delete(ub.keys, key)
+		w.unrefLocked(key)
+	}
+	if len(ub.keys) == 0 {
+		delete(w.users, userID)
+	}
+	return nil
+}
+
+func (w *writeBuffer) unrefLocked(key string) {
+	bb := w.blocks[key]
+	if bb.refs--; bb.refs == 0 {
+		delete(w.blocks, key)
+		w.size -= uint64(len(bb.blk.RawData()))
+	}
+}
+
+// get returns c if it is buffered. It is safe to call on a nil buffer.
+func (w *writeBuffer) get(c cid.Cid) (blocks.Block, bool) {
+	if w == nil {
+		return nil, false
+	}
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	bb, ok := w.blocks[blockKey(c.Hash())]
+	if !ok {
+		return nil, false
+	}
+	return bb.blk, true
+}
+
+// cids returns the CIDs of the buffered blocks. It is safe to call on a nil
+// buffer.
+func (w *writeBuffer) cids() []cid.Cid {
+	if w == nil {
+		return nil
+	}
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	cs := make([]cid.Cid, 0, len(w.blocks))
+	for _, bb := range w.blocks {
+		cs = append(cs, bb.blk.Cid())
+	}
+	return cs
+}
+
+// remove drops c from the buffers of all users. Blocks being written are
+// still written. It is safe to call on a nil buffer.
+func (w *writeBuffer) remove(c cid.Cid) {
+	if w == nil {
+		return
+	}
+	key := blockKey(c.Hash())
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	for _, ub := range w.users {
+		if _, ok := ub.keys[key]; !ok {
+			continue
+		}
+		delete(ub.keys, key)
+		w.unrefLocked(key)
+		for i, b := range ub.pending {
+			if blockKey(b.Cid().Hash()) == key {
+				ub.pending = append(ub.pending[:i], ub.pending[i+1:]...)
+				ub.size -= uint64(len(b.RawData()))
+				break
+			}
+		}
+	}
+}
+
+// close stops accepting new blocks and writes all the buffered blocks,
+// retrying the failed batches according to the policy of the buffer. Blocks
+// that still cannot be written are reported and stay buffered.
+func (w *writeBuffer) close() error {
+	w.lk.Lock()
+	w.closed = true
+	w.lk.Unlock()
+	return retry.Do(context.Background(), w.policy, "bufferClose", func(string) error {
+		return retry.Retry(w.writeAll(), 0)
+	})
+}
+
+// writeAll writes all the buffered blocks once the writes started by the
+// timers are done. It must only be called once the buffer is closed, so that
+// no new timer is armed.
+func (w *writeBuffer) writeAll() error {
+	w.lk.Lock()
+	for _, ub := range w.users {
+		w.stopTimerLocked(ub)
+	}
+	w.lk.Unlock()
+	// Blocks the timers fail to write are put back in the buffer.
+	w.timers.Wait()
+
+	w.lk.Lock()
+	batches := make(map[string][]blocks.Block, len(w.users))
+	for userID, ub := range w.users {
+		if batch := w.takeLocked(ub); len(batch) != 0 {
+			batches[userID] = batch
+		}
+	}
+	w.lk.Unlock()
+
+	var (
+		failed int
+		first  error
+	)
+	for userID, batch := range batches {
+		ctx := context.Background()
+		if userID != "" {
+			ctx = context.WithValue(ctx, "userID", userID)
+		}
+		if err := w.write(ctx, userID, batch); err != nil {
+			failed += len(batch)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("could not write %d buffered blocks: %w", failed, first)
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+
+	"github.com/ipfs/go-blockservice/retry"
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+func TestWriteBufferAggregates(t *testing.T) {
+	bserv, up, idx := newCdnBlockService(t, WithWriteBuffer(1<<20, time.Hour))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+
+	var (
+		bs []blocks.Block
+		ks []cid.Cid
+	)
+	for i := 0; i < 10; i++ {
+		b := bgen.Next()
+		bs = append(bs, b)
+		ks = append(ks, b.Cid())
+		if err := bserv.AddBlock(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Adding a buffered block again is a no-op.
+	if err := bserv.AddBlocks(ctx, bs[:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := bserv.GetBlock(ctx, ks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.RawData(), bs[0].RawData()) {
+		t.Fatal("block data is not equal")
+	}
+	n := 0
+	for range bserv.GetBlocks(ctx, ks) {
+		n++
+	}
+	if n != len(ks) {
+		t.Fatalf("expected %d buffered blocks, got %d", len(ks), n)
+	}
+	if up.Uploads != 0 || up.Appends != 0 || up.Reads != 0 {
+		t.Fatalf("expected buffered blocks not to hit the uploader, got %d uploads, %d appends and %d reads", up.Uploads, up.Appends, up.Reads)
+	}
+
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 1 || up.Appends != 0 {
+		t.Fatalf("expected a single upload on close, got %d uploads and %d appends", up.Uploads, up.Appends)
+	}
+	for _, c := range ks {
+		if _, err := idx.Get(ctx, blockKey(c.Hash())); err != nil {
+			t.Fatalf("expected %s to be indexed: %s", c, err)
+		}
+	}
+	// Adds after close are written directly.
+	if err := bserv.AddBlock(ctx, bgen.Next()); err != nil {
+		t.Fatal(err)
+	}
+	if up.Appends != 1 {
+		t.Fatalf("expected a direct append after close, got %d", up.Appends)
+	}
+}
+
+func TestWriteBufferFlushesOnSize(t *testing.T) {
+	bgen := butil.NewBlockGenerator()
+	b1, b2 := bgen.Next(), bgen.Next()
+	bserv, up, _ := newCdnBlockService(t, WithWriteBuffer(uint64(len(b1.RawData())+1), time.Hour))
+	ctx := context.Background()
+
+	if err := bserv.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 0 {
+		t.Fatal("expected the first block to be buffered")
+	}
+	if err := bserv.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 1 {
+		t.Fatalf("expected a full buffer to be written, got %d uploads", up.Uploads)
+	}
+}
+
+func TestWriteBufferFlushesOnDelay(t *testing.T) {
+	bserv, _, idx := newCdnBlockService(t, WithWriteBuffer(1<<20, 10*time.Millisecond))
+	ctx := context.Background()
+
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bserv.AddBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := idx.Get(ctx, blockKey(b.Cid().Hash())); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the buffered block to be written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// flakyUploader fails the uploads until it is fixed.
+type flakyUploader struct {
+	*uploader.Mock
+	lk    sync.Mutex
+	fixed bool
+}
+
+func (fu *flakyUploader) Upload(ctx context.Context, parts []uploader.Part) (*uploader.PackResponse, error) {
+	fu.lk.Lock()
+	fixed := fu.fixed
+	fu.lk.Unlock()
+	if !fixed {
+		return nil, errors.New("connection refused")
+	}
+	return fu.Mock.Upload(ctx, parts)
+}
+
+func TestWriteBufferKeepsFailedBlocks(t *testing.T) {
+	bgen := butil.NewBlockGenerator()
+	b1, b2 := bgen.Next(), bgen.Next()
+	up := &flakyUploader{Mock: uploader.NewMock()}
+	bserv, _, idx := newCdnBlockService(t, WithUploaderClient(up), WithWriteBuffer(uint64(len(b1.RawData())), time.Hour))
+	ctx := context.Background()
+
+	// The block is accepted, its write is retried later.
+	if err := bserv.AddBlock(ctx, b1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bserv.GetBlock(ctx, b1.Cid()); err != nil {
+		t.Fatalf("expected the block to stay buffered: %s", err)
+	}
+
+	up.lk.Lock()
+	up.fixed = true
+	up.lk.Unlock()
+	if err := bserv.AddBlock(ctx, b2); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []blocks.Block{b1, b2} {
+		if _, err := idx.Get(ctx, blockKey(b.Cid().Hash())); err != nil {
+			t.Fatalf("expected %s to be written: %s", b.Cid(), err)
+		}
+	}
+	if up.Uploads != 1 {
+		t.Fatalf("expected both blocks in a single upload, got %d", up.Uploads)
+	}
+}
+
+func TestWriteBufferLimit(t *testing.T) {
+	bgen := butil.NewBlockGenerator()
+	b1, b2, b3 := bgen.Next(), bgen.Next(), bgen.Next()
+	up := &flakyUploader{Mock: uploader.NewMock()}
+	size := uint64(len(b1.RawData()))
+	bserv, _, _ := newCdnBlockService(t, WithUploaderClient(up),
+		WithWriteBuffer(size, time.Hour), WithWriteBufferLimit(2*size), WithRetryPolicy(retry.Policy{MaxAttempts: 1}))
+	alice := context.WithValue(context.Background(), "userID", "alice")
+	bob := context.WithValue(context.Background(), "userID", "bob")
+
+	// The failed writes keep both blocks buffered, which fills the buffer.
+	if err := bserv.AddBlock(alice, b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.AddBlock(bob, b2); err != nil {
+		t.Fatal(err)
+	}
+	// Further adds are written directly, and report their failure.
+	if err := bserv.AddBlock(alice, b3); !errors.Is(err, ErrUploaderUnavailable) {
+		t.Fatalf("expected the direct write to fail, got %v", err)
+	}
+	if _, ok := bserv.(*blockService).buffer.get(b3.Cid()); ok {
+		t.Fatal("expected the block not to be buffered")
+	}
+	// Adding buffered blocks again does not need room.
+	if err := bserv.AddBlock(bob, b1); err != nil {
+		t.Fatal(err)
+	}
+
+	up.lk.Lock()
+	up.fixed = true
+	up.lk.Unlock()
+	if err := bserv.AddBlock(alice, b3); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bserv.(*blockService).buffer.size; n != 0 {
+		t.Fatalf("expected the buffer to be empty, got %d bytes", n)
+	}
+}
+
+// failingUploads fails its first uploads.
+type failingUploads struct {
+	*uploader.Mock
+	lk       sync.Mutex
+	failures int
+}
+
+func (fu *failingUploads) Upload(ctx context.Context, parts []uploader.Part) (*uploader.PackResponse, error) {
+	fu.lk.Lock()
+	fail := fu.failures > 0
+	fu.failures--
+	fu.lk.Unlock()
+	if fail {
+		return nil, errors.New("connection refused")
+	}
+	return fu.Mock.Upload(ctx, parts)
+}
+
+func TestWriteBufferCloseRetries(t *testing.T) {
+	up := &failingUploads{Mock: uploader.NewMock(), failures: 2}
+	bserv, _, idx := newCdnBlockService(t, WithUploaderClient(up),
+		WithWriteBuffer(1<<20, time.Hour), WithRetryPolicy(retry.Policy{MaxAttempts: 3}))
+	ctx := context.Background()
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bserv.AddBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bserv.Close(); err != nil {
+		t.Fatalf("expected close to retry the failed write, got %v", err)
+	}
+	if _, err := idx.Get(ctx, blockKey(b.Cid().Hash())); err != nil {
+		t.Fatalf("expected the block to be written: %s", err)
+	}
+}
+
+func TestWriteBufferCloseKeepsFailedBlocks(t *testing.T) {
+	up := &flakyUploader{Mock: uploader.NewMock()}
+	bserv, _, _ := newCdnBlockService(t, WithUploaderClient(up),
+		WithWriteBuffer(1<<20, time.Hour), WithRetryPolicy(retry.Policy{MaxAttempts: 2}),
+		WithCompaction(time.Hour, CompactionOptions{}))
+	ctx := context.Background()
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bserv.AddBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	err := bserv.Close()
+	if !errors.Is(err, ErrUploaderUnavailable) {
+		t.Fatalf("expected close to report the failed write, got %v", err)
+	}
+	// Closing again reports the same failure.
+	if err2 := bserv.Close(); err2 != err {
+		t.Fatalf("expected the second close to return %v, got %v", err, err2)
+	}
+	if _, ok := bserv.(*blockService).buffer.get(b.Cid()); !ok {
+		t.Fatal("expected the block to stay buffered")
+	}
+}
+
+func TestWriteBufferDelete(t *testing.T) {
+	bserv, up, _ := newCdnBlockService(t, WithWriteBuffer(1<<20, time.Hour))
+	ctx := context.Background()
+
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bserv.AddBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.DeleteBlock(ctx, b.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bserv.(*blockService).buffer.get(b.Cid()); ok {
+		t.Fatal("expected the block to be removed from the buffer")
+	}
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 0 {
+		t.Fatalf("expected nothing to be written, got %d uploads", up.Uploads)
+	}
+}
@@ -0,0 +1,199 @@
+package blockservice
+
+import (
+	"container/list"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+const (
+	// recentRatio is the share of the byte budget reserved for blocks seen
+	// only once, before they start evicting frequently used ones.
+	recentRatio = 0.25
+	// minGhostEntries is the minimum number of evicted keys remembered to
+	// detect blocks coming back.
+	minGhostEntries = 64
+)
+
+// CacheStats are the counters of a BlockCache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     uint64
+}
+
+type cacheEntry struct {
+	key      string
+	data     []byte
+	frequent bool
+}
+
+// BlockCache is an in-memory cache of block data bounded by a byte budget.
+// It uses the 2Q eviction policy: blocks enter a FIFO queue of recent blocks
+// and are promoted to an LRU queue of frequent blocks when requested again,
+// so that a scan over many blocks does not flush the hot ones.
+//
+// Blocks are keyed by multihash. A BlockCache is safe for concurrent use.
+type BlockCache struct {
+	lk       sync.Mutex
+	maxBytes uint64
+
+	items    map[string]*list.Element
+	recent   *list.List
+	frequent *list.List
+	// recentBytes and frequentBytes are the sizes of the two queues.
+	recentBytes   uint64
+	frequentBytes uint64
+
+	// ghosts remembers keys recently evicted from the recent queue.
+	ghosts     *list.List
+	ghostItems map[string]*list.Element
+
+	stats CacheStats
+}
+
+// NewBlockCache returns a BlockCache holding at most maxBytes of block data.
+func NewBlockCache(maxBytes uint64) *BlockCache {
+	return &BlockCache{
+		maxBytes:   maxBytes,
+		items:      make(map[string]*list.Element),
+		recent:     list.New(),
+		frequent:   list.New(),
+		ghosts:     list.New(),
+		ghostItems: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the block c if its data is cached.
+func (bc *BlockCache) Get(c cid.Cid) (blocks.Block, bool) {
+	key := string(c.Hash())
+
+	bc.lk.Lock()
+	el, ok := bc.items[key]
+	if !ok {
+		bc.stats.Misses++
+		bc.lk.Unlock()
+		return nil, false
+	}
+	bc.stats.Hits++
+	e := el.Value.(*cacheEntry)
+	if e.frequent {
+		bc.frequent.MoveToFront(el)
+	} else {
+		bc.recent.Remove(el)
+		bc.recentBytes -= uint64(len(e.data))
+		e.frequent = true
+		bc.items[key] = bc.frequent.PushFront(e)
+		bc.frequentBytes += uint64(len(e.data))
+	}
+	data := e.data
+	bc.lk.Unlock()
+
+	blk, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, false
+	}
+	return blk, true
+}
+
+// Add caches the data of b. Blocks larger than the whole budget are ignored.
+func (bc *BlockCache) Add(b blocks.Block) {
+	key := string(b.Cid().Hash())
+	data := b.RawData()
+	size := uint64(len(data))
+	if size > bc.maxBytes {
+		return
+	}
+
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	if _, ok := bc.items[key]; ok {
+		return
+	}
+
+	e := &cacheEntry{key: key, data: data}
+	if gel, ok := bc.ghostItems[key]; ok {
+		// Evicted recently and requested again: it is frequently used.
+		bc.ghosts.Remove(gel)
+		delete(bc.ghostItems, key)
+		e.frequent = true
+		bc.items[key] = bc.frequent.PushFront(e)
+		bc.frequentBytes += size
+	} else {
+		bc.items[key] = bc.recent.PushFront(e)
+		bc.recentBytes += size
+	}
+	bc.evict()
+}
+
+// Remove drops c from the cache.
+func (bc *BlockCache) Remove(c cid.Cid) {
+	key := string(c.Hash())
+
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+
+	if el, ok := bc.items[key]; ok {
+		bc.removeElement(el)
+	}
+	if gel, ok := bc.ghostItems[key]; ok {
+		bc.ghosts.Remove(gel)
+		delete(bc.ghostItems, key)
+	}
+}
+
+// Stats returns a snapshot of the cache counters.
+func (bc *BlockCache) Stats() CacheStats {
+	bc.lk.Lock()
+	defer bc.lk.Unlock()
+	stats := bc.stats
+	stats.Entries = len(bc.items)
+	stats.Bytes = bc.recentBytes + bc.frequentBytes
+	return stats
+}
+
+func (bc *BlockCache) removeElement(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	if e.frequent {
+		bc.frequent.Remove(el)
+		bc.frequentBytes -= uint64(len(e.data))
+	} else {
+		bc.recent.Remove(el)
+		bc.recentBytes -= uint64(len(e.data))
+	}
+	delete(bc.items, e.key)
+}
+
+// evict drops blocks until the cache fits its budget. Recent blocks go first
+// as long as they use more than their share of the budget.
+func (bc *BlockCache) evict() {
+	recentTarget := uint64(float64(bc.maxBytes) * recentRatio)
+	for bc.recentBytes+bc.frequentBytes > bc.maxBytes {
+		if bc.recent.Len() > 0 && (bc.recentBytes > recentTarget || bc.frequent.Len() == 0) {
+			el := bc.recent.Back()
+			bc.removeElement(el)
+			bc.addGhost(el.Value.(*cacheEntry).key)
+		} else {
+			bc.removeElement(bc.frequent.Back())
+		}
+		bc.stats.Evictions++
+	}
+}
+
+func (bc *BlockCache) addGhost(key string) {
+	bc.ghostItems[key] = bc.ghosts.PushFront(key)
+	limit := 2 * len(bc.items)
+	if limit < minGhostEntries {
+		limit = minGhostEntries
+	}
+	for bc.ghosts.Len() > limit {
+		el := bc.ghosts.Back()
+		bc.ghosts.Remove(el)
+		delete(bc.ghostItems, el.Value.(string))
+	}
+}
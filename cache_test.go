@@ -0,0 +1,112 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+func sizedBlock(i, size int) blocks.Block {
+	data := bytes.Repeat([]byte{'x'}, size)
+	copy(data, fmt.Sprintf("block %d", i))
+	return blocks.NewBlock(data)
+}
+
+func TestBlockCacheByteBudget(t *testing.T) {
+	bc := NewBlockCache(100)
+	var bs []blocks.Block
+	for i := 0; i < 5; i++ {
+		b := sizedBlock(i, 30)
+		bs = append(bs, b)
+		bc.Add(b)
+	}
+	stats := bc.Stats()
+	if stats.Bytes > 100 || stats.Entries != 3 || stats.Evictions != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if _, ok := bc.Get(bs[0].Cid()); ok {
+		t.Fatal("oldest block should have been evicted")
+	}
+	got, ok := bc.Get(bs[4].Cid())
+	if !ok || !bytes.Equal(got.RawData(), bs[4].RawData()) {
+		t.Fatal("newest block should be cached")
+	}
+
+	bc.Add(sizedBlock(99, 101))
+	if bc.Stats().Entries != 3 {
+		t.Fatal("blocks larger than the budget should not be cached")
+	}
+
+	bc.Remove(bs[4].Cid())
+	if _, ok := bc.Get(bs[4].Cid()); ok {
+		t.Fatal("removed block should not be cached")
+	}
+	stats = bc.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 {
+		t.Fatalf("unexpected counters %+v", stats)
+	}
+}
+
+func TestBlockCacheScanResistance(t *testing.T) {
+	bc := NewBlockCache(100)
+	hot := sizedBlock(0, 10)
+	bc.Add(hot)
+	if _, ok := bc.Get(hot.Cid()); !ok {
+		t.Fatal("expected hot block to be cached")
+	}
+
+	// A scan over many blocks seen once must not evict the hot block.
+	for i := 1; i < 100; i++ {
+		bc.Add(sizedBlock(i, 10))
+	}
+	if _, ok := bc.Get(hot.Cid()); !ok {
+		t.Fatal("hot block was evicted by a scan")
+	}
+}
+
+func TestGetBlockUsesCache(t *testing.T) {
+	ctx := context.Background()
+	up := uploader.NewMock()
+	cache := NewBlockCache(1 << 20)
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()), WithBlockCache(cache),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range bserv.GetBlocks(ctx, []cid.Cid{block.Cid()}) {
+	}
+	if up.Reads != 1 {
+		t.Fatalf("expected a single CDN read, got %d", up.Reads)
+	}
+	if stats := cache.Stats(); stats.Hits != 3 {
+		t.Fatalf("expected 3 cache hits, got %+v", stats)
+	}
+
+	if err := bserv.DeleteBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(block.Cid()); ok {
+		t.Fatal("DeleteBlock should invalidate the cache")
+	}
+}
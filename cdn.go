@@ -0,0 +1,357 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// ErrHashMismatch is returned when the bytes served by the CDN for a block do
+// not hash to its CID, for instance because of a corrupted pack or a wrong
+// offset in the index.
+var ErrHashMismatch = errors.New("blockservice: block data does not match its CID")
+
+// getBlockCached returns c from the write buffer or the block cache, if any.
+// Blocks served from memory are accounted for like blocks read from the CDN.
+func (s *blockService) getBlockCached(ctx context.Context, c cid.Cid) (blocks.Block, bool) {
+	blk, ok := s.buffer.get(c)
+	if !ok && s.cache != nil {
+		blk, ok = s.cache.Get(c)
+	}
+	if ok && s.isDedicatedGateway {
+		s.addBandwidthUsage(uint64(len(blk.RawData())), c.Hash().HexString())
+	}
+	return blk, ok
+}
+
+// fetchResult is the outcome of a CDN fetch shared by concurrent callers.
+// Callers may ask for the same multihash under different CIDs, so only the
+// verified bytes are shared and each caller builds its own block.
+type fetchResult struct {
+	data    []byte
+	indexed bool
+}
+
+// fetchBlockCdn looks c up in the index and reads it from the CDN. Concurrent
+// calls for the same multihash share a single index lookup and CDN read, each
+// caller still waiting on its own context. indexed reports whether the index
+// lookup succeeded, so that callers can tell a block missing from the index
+// from one the CDN failed to serve.
+//
+// Bandwidth is not accounted for here, as it has to be reported once per
+// caller rather than once per fetch.
+func (s *blockService) fetchBlockCdn(ctx context.Context, c cid.Cid) (blocks.Block, bool, error) {
+	ch := s.inflight.DoChan(string(c.Hash()), func() (interface{}, error) {
+		// The fetch outlives the caller that started it if other callers
+		// are still waiting for it, but not a stalled uploader.
+		fctx, cancel := context.WithTimeout(detachedContext{ctx}, s.fetchTimeout)
+		defer cancel()
+
+		f, err := s.getFileInfo(fctx, c.Hash())
+		if err != nil {
+			return fetchResult{}, err
+		}
+		bdata, err := s.readRange(fctx, f.FileRecordID, f.Offset, f.Size)
+		if err != nil {
+			return fetchResult{indexed: true}, err
+		}
+		blk, err := s.checkCdnData(fctx, c, f, bdata)
+		if err != nil {
+			return fetchResult{indexed: true}, err
+		}
+		if s.cache != nil {
+			s.cache.Add(blk)
+		}
+		return fetchResult{data: blk.RawData(), indexed: true}, nil
+	})
+
+	select {
+	case res := <-ch:
+		r := res.Val.(fetchResult)
+		if res.Err != nil {
+			return nil, r.indexed, res.Err
+		}
+		// The data hashes to the multihash shared by all the callers.
+		blk, err := blocks.NewBlockWithCid(r.data, c)
+		return blk, r.indexed, err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// detachedContext keeps the values of a context but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// readBlockCdn fetches the block c stored at f from the CDN, and checks that
+// the returned bytes hash to c.
+func (s *blockService) readBlockCdn(ctx context.Context, c cid.Cid, f fileInfo) (blocks.Block, error) {
+	bdata, err := s.readRange(ctx, f.FileRecordID, f.Offset, f.Size)
+	if err != nil {
+		return nil, err
+	}
+	return s.blockFromCdnData(ctx, c, f, bdata)
+}
+
+// blockFromCdnData checks that bdata, read from the CDN at f, hashes to c and
+// accounts for the bandwidth used to serve it.
+func (s *blockService) blockFromCdnData(ctx context.Context, c cid.Cid, f fileInfo, bdata []byte) (blocks.Block, error) {
+	blk, err := s.checkCdnData(ctx, c, f, bdata)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.isDedicatedGateway {
+		s.addBandwidthUsage(f.Size, c.Hash().HexString())
+	}
+	return blk, nil
+}
+
+// checkCdnData checks that bdata, read from the CDN at f, hashes to c.
+func (s *blockService) checkCdnData(ctx context.Context, c cid.Cid, f fileInfo, bdata []byte) (blocks.Block, error) {
+	if err := verifyBlockData(c, bdata); err != nil {
+		err = fmt.Errorf("%w: %s at %s[%d:%d]", err, c, f.FileRecordID, f.Offset, f.Offset+f.Size)
+		if s.invalidateOnMismatch {
+			if derr := s.index.Delete(ctx, blockKey(c.Hash())); derr != nil {
+				logger.Errorf("could not invalidate index entry of %s: %s", c, derr)
+			}
+		}
+		return nil, err
+	}
+
+	return blocks.NewBlockWithCid(bdata, c)
+}
+
+// indexBatchSize bounds the number of keys looked up in a single BatchGet.
+const indexBatchSize = 1024
+
+// defaultFetchTimeout bounds the CDN fetches shared by concurrent GetBlock
+// calls unless configured with WithFetchTimeout.
+const defaultFetchTimeout = time.Minute
+
+// defaultFetchConcurrency is the number of CDN range reads GetBlocks runs in
+// parallel unless configured with WithFetchConcurrency.
+const defaultFetchConcurrency = 16
+
+// Defaults for merging the CDN reads of blocks stored close to each other in
+// the same pack, see WithRangeCoalescing.
+const (
+	defaultCoalesceGap  = 4 << 10
+	defaultCoalesceSpan = 4 << 20
+)
+
+// rangeMember is a block read as part of a coalesced range.
+type rangeMember struct {
+	c cid.Cid
+	f fileInfo
+}
+
+// coalescedRange is a single CDN read covering one or more blocks of a pack.
+type coalescedRange struct {
+	fileRecordID string
+	offset       uint64
+	size         uint64
+	members      []rangeMember
+}
+
+// coalesceRanges groups the blocks of found by pack, and merges the ranges of
+// blocks separated by at most gap bytes into reads of at most span bytes.
+func coalesceRanges(found map[cid.Cid]fileInfo, gap, span uint64) []*coalescedRange {
+	byPack := make(map[string][]rangeMember)
+	for c, f := range found {
+		byPack[f.FileRecordID] = append(byPack[f.FileRecordID], rangeMember{c, f})
+	}
+
+	var ranges []*coalescedRange
+	for id, members := range byPack {
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].f.Offset < members[j].f.Offset
+		})
+
+		var cur *coalescedRange
+		for _, m := range members {
+			end := m.f.Offset + m.f.Size
+			if cur != nil && m.f.Offset <= cur.offset+cur.size+gap && end-cur.offset <= span {
+				if end > cur.offset+cur.size {
+					cur.size = end - cur.offset
+				}
+				cur.members = append(cur.members, m)
+				continue
+			}
+			cur = &coalescedRange{
+				fileRecordID: id,
+				offset:       m.f.Offset,
+				size:         m.f.Size,
+				members:      []rangeMember{m},
+			}
+			ranges = append(ranges, cur)
+		}
+	}
+	return ranges
+}
+
+// readRangeCdn fetches a coalesced range from the CDN and splits it back into
+// blocks. Blocks that could not be served are passed to miss.
+func (s *blockService) readRangeCdn(ctx context.Context, r *coalescedRange, found func(blocks.Block), miss func(cid.Cid)) {
+	if len(r.members) == 1 {
+		m := r.members[0]
+		blk, err := s.readBlockCdn(ctx, m.c, m.f)
+		if err != nil {
+			logger.Debugf("could not get %s from the cdn: %s", m.c, err)
+			miss(m.c)
+			return
+		}
+		found(blk)
+		return
+	}
+
+	data, err := s.readRange(ctx, r.fileRecordID, r.offset, r.size)
+	if err != nil {
+		logger.Debugf("could not get %d blocks of %s from the cdn: %s", len(r.members), r.fileRecordID, err)
+		for _, m := range r.members {
+			miss(m.c)
+		}
+		return
+	}
+	for _, m := range r.members {
+		start := m.f.Offset - r.offset
+		blk, err := s.blockFromCdnData(ctx, m.c, m.f, data[start:start+m.f.Size])
+		if err != nil {
+			logger.Debugf("could not get %s from the cdn: %s", m.c, err)
+			miss(m.c)
+			continue
+		}
+		found(blk)
+	}
+}
+
+// getBlocksCdn sends the blocks of ks found on the CDN to out as they arrive,
+// and returns the CIDs that could not be served from it. Index entries are
+// resolved in batches, reads of neighbouring blocks of a pack are merged, and
+// the CDN reads are spread over a bounded number of workers.
+func (s *blockService) getBlocksCdn(ctx context.Context, ks []cid.Cid, out chan<- blocks.Block) []cid.Cid {
+	var (
+		lk     sync.Mutex
+		misses []cid.Cid
+		wg     sync.WaitGroup
+	)
+	miss := func(c cid.Cid) {
+		lk.Lock()
+		misses = append(misses, c)
+		lk.Unlock()
+	}
+
+	send := func(blk blocks.Block) {
+		select {
+		case out <- blk:
+		case <-ctx.Done():
+		}
+	}
+	fetched := func(blk blocks.Block) {
+		if s.cache != nil {
+			s.cache.Add(blk)
+		}
+		send(blk)
+	}
+
+	jobs := make(chan *coalescedRange)
+	workers := s.fetchConcurrency
+	if workers <= 0 {
+		workers = defaultFetchConcurrency
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				s.readRangeCdn(ctx, r, fetched, miss)
+			}
+		}()
+	}
+
+	found := s.resolveFileInfos(ctx, ks, miss)
+	gap, span := uint64(defaultCoalesceGap), uint64(defaultCoalesceSpan)
+	if s.coalesceSpan != 0 {
+		gap, span = s.coalesceGap, s.coalesceSpan
+	}
+feed:
+	for _, r := range coalesceRanges(found, gap, span) {
+		select {
+		case jobs <- r:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return misses
+}
+
+// resolveFileInfos looks up the index entries of ks in batches. CIDs that are
+// not indexed, or whose lookup failed, are passed to miss.
+func (s *blockService) resolveFileInfos(ctx context.Context, ks []cid.Cid, miss func(cid.Cid)) map[cid.Cid]fileInfo {
+	found := make(map[cid.Cid]fileInfo, len(ks))
+	for start := 0; start < len(ks); start += indexBatchSize {
+		end := start + indexBatchSize
+		if end > len(ks) {
+			end = len(ks)
+		}
+		batch := ks[start:end]
+
+		keys := make([]string, len(batch))
+		for i, c := range batch {
+			keys[i] = blockKey(c.Hash())
+		}
+		values, err := s.index.BatchGet(ctx, keys)
+		if err != nil {
+			logger.Errorf("could not look up %d blocks in the index: %s", len(batch), err)
+			for _, c := range batch {
+				miss(c)
+			}
+			continue
+		}
+
+		for i, c := range batch {
+			if values[i] == nil {
+				miss(c)
+				continue
+			}
+			var f fileInfo
+			if err := json.Unmarshal(values[i], &f); err != nil {
+				logger.Errorf("invalid index entry for %s: %s", c, err)
+				miss(c)
+				continue
+			}
+			found[c] = f
+		}
+	}
+	return found
+}
+
+// verifyBlockData hashes data with the multihash function of c and returns
+// ErrHashMismatch if the digest differs.
+func verifyBlockData(c cid.Cid, data []byte) error {
+	chk, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(chk.Hash(), c.Hash()) {
+		return ErrHashMismatch
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+	ipld "github.com/ipfs/go-ipld-format"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+func TestCoalesceRanges(t *testing.T) {
+	bgen := butil.NewBlockGenerator()
+	c := func() cid.Cid { return bgen.Next().Cid() }
+
+	found := map[cid.Cid]fileInfo{
+		c(): {FileRecordID: "a", Offset: 0, Size: 10},
+		c(): {FileRecordID: "a", Offset: 12, Size: 10},   // within the gap
+		c(): {FileRecordID: "a", Offset: 100, Size: 10},  // too far
+		c(): {FileRecordID: "b", Offset: 22, Size: 10},   // other pack
+		c(): {FileRecordID: "a", Offset: 110, Size: 200}, // exceeds the span
+	}
+	ranges := coalesceRanges(found, 4, 100)
+
+	got := make(map[string][][2]uint64)
+	for _, r := range ranges {
+		got[r.fileRecordID] = append(got[r.fileRecordID], [2]uint64{r.offset, r.size})
+	}
+	if len(ranges) != 4 {
+		t.Fatalf("expected 4 ranges, got %v", got)
+	}
+	for _, want := range [][2]uint64{{0, 22}, {100, 10}, {110, 200}} {
+		ok := false
+		for _, r := range got["a"] {
+			ok = ok || r == want
+		}
+		if !ok {
+			t.Fatalf("missing range %v in %v", want, got["a"])
+		}
+	}
+}
+
+func TestGetBlocksCoalescesReads(t *testing.T) {
+	ctx := context.Background()
+	up := uploader.NewMock()
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	var (
+		bs []blocks.Block
+		ks []cid.Cid
+	)
+	for i := 0; i < 10; i++ {
+		b := bgen.Next()
+		bs = append(bs, b)
+		ks = append(ks, b.Cid())
+	}
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+
+	n := 0
+	for range bserv.GetBlocks(ctx, ks) {
+		n++
+	}
+	if n != len(bs) {
+		t.Fatalf("expected %d blocks, got %d", len(bs), n)
+	}
+	if up.Reads != 1 {
+		t.Fatalf("expected a single range read, got %d", up.Reads)
+	}
+}
+
+// gatedUploader blocks range reads until its gate is closed.
+type gatedUploader struct {
+	*uploader.Mock
+	gate chan struct{}
+}
+
+func (g *gatedUploader) ReadRange(ctx context.Context, fileRecordID string, offset, size uint64) ([]byte, error) {
+	select {
+	case <-g.gate:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return g.Mock.ReadRange(ctx, fileRecordID, offset, size)
+}
+
+func TestConcurrentGetBlockIsDeduplicated(t *testing.T) {
+	ctx := context.Background()
+	up := &gatedUploader{Mock: uploader.NewMock(), gate: make(chan struct{})}
+	pin := newRecordingPinning()
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()),
+		WithPinningClient(pin), WithDedicatedGateway(true),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 20
+	var (
+		wg      sync.WaitGroup
+		started sync.WaitGroup
+	)
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			blk, err := bserv.GetBlock(ctx, block.Cid())
+			if err == nil && !bytes.Equal(blk.RawData(), block.RawData()) {
+				err = fmt.Errorf("block data is not equal")
+			}
+			errs <- err
+		}()
+	}
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(up.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if up.Reads != 1 {
+		t.Fatalf("expected a single CDN read, got %d", up.Reads)
+	}
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := uint64(callers * len(block.RawData()))
+	if got := pin.bandwidth[block.Cid().Hash().HexString()]; got != want {
+		t.Fatalf("expected %d bytes of bandwidth for %d requests, got %d", want, callers, got)
+	}
+}
+
+func TestConcurrentGetBlockKeepsCid(t *testing.T) {
+	ctx := context.Background()
+	up := &gatedUploader{Mock: uploader.NewMock(), gate: make(chan struct{})}
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both CIDs share the multihash, and so the fetch.
+	cids := []cid.Cid{block.Cid(), cid.NewCidV1(cid.Raw, block.Cid().Hash())}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(cids))
+	for _, c := range cids {
+		wg.Add(1)
+		go func(c cid.Cid) {
+			defer wg.Done()
+			blk, err := bserv.GetBlock(ctx, c)
+			if err == nil && !blk.Cid().Equals(c) {
+				err = fmt.Errorf("asked for %s, got %s", c, blk.Cid())
+			}
+			errs <- err
+		}(c)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(up.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if up.Reads != 1 {
+		t.Fatalf("expected a single CDN read, got %d", up.Reads)
+	}
+}
+
+func TestGetBlockWaiterCancellation(t *testing.T) {
+	up := &gatedUploader{Mock: uploader.NewMock(), gate: make(chan struct{})}
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := bserv.GetBlock(ctx, block.Cid()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the caller to give up with its context, got %v", err)
+	}
+
+	// The shared fetch is not canceled with its first caller.
+	close(up.gate)
+	if _, err := bserv.GetBlock(context.Background(), block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetBlockFetchTimeout(t *testing.T) {
+	up := &gatedUploader{Mock: uploader.NewMock(), gate: make(chan struct{})}
+	breaker := NewCircuitBreaker(BreakerOptions{Failures: 1, OpenTimeout: time.Millisecond})
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()),
+		WithCircuitBreaker(breaker), WithFetchTimeout(20*time.Millisecond),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave the breaker half open, the stalled read is its probe.
+	breaker.allow()
+	breaker.done(context.Background(), errors.New("down"), 0)
+	time.Sleep(5 * time.Millisecond)
+
+	// The caller does not give up, the shared fetch does.
+	if _, err := bserv.GetBlock(context.Background(), block.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected the fetch to time out, got %v", err)
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("expected the timed out probe to reopen the breaker, got %v", breaker.State())
+	}
+	close(up.gate)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := bserv.GetBlock(context.Background(), block.Cid()); err != nil {
+		t.Fatalf("expected the timed out probe to be replaced, got %v", err)
+	}
+	if breaker.State() != BreakerClosed {
+		t.Fatalf("expected the new probe to close the breaker, got %v", breaker.State())
+	}
+}
+
+func TestStalledReadsOpenBreaker(t *testing.T) {
+	up := &gatedUploader{Mock: uploader.NewMock(), gate: make(chan struct{})}
+	breaker := NewCircuitBreaker(BreakerOptions{Failures: 2, OpenTimeout: time.Hour})
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(up), WithIndex(NewMemoryIndex()),
+		WithCircuitBreaker(breaker), WithFetchTimeout(20*time.Millisecond),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := bserv.GetBlock(context.Background(), block.Cid()); !ipld.IsNotFound(err) {
+			t.Fatalf("expected the fetch to time out, got %v", err)
+		}
+	}
+	if breaker.State() != BreakerOpen {
+		t.Fatalf("expected stalled reads to open the breaker, got %+v", breaker.Stats())
+	}
+	close(up.gate)
+}
+
+// blockingPinning blocks bandwidth reports until its gate is closed.
+type blockingPinning struct {
+	*recordingPinning
+	gate chan struct{}
+}
+
+func (p *blockingPinning) ReportBandwidth(ctx context.Context, cid string, amount uint64) error {
+	<-p.gate
+	return p.recordingPinning.ReportBandwidth(ctx, cid, amount)
+}
+
+func TestBandwidthReportIsAsync(t *testing.T) {
+	ctx := context.Background()
+	pin := &blockingPinning{recordingPinning: newRecordingPinning(), gate: make(chan struct{})}
+	cache := NewBlockCache(1 << 20)
+	bserv := New(
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		nil,
+		WithUploaderClient(uploader.NewMock()), WithIndex(NewMemoryIndex()),
+		WithPinningClient(pin), WithDedicatedGateway(true), WithBlockCache(cache),
+	)
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := bserv.AddBlock(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	// Reads, including cache hits, do not wait for the pinning service.
+	for i := 0; i < 3; i++ {
+		if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(pin.gate)
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := uint64(3 * len(block.RawData()))
+	if got := pin.bandwidth[block.Cid().Hash().HexString()]; got != want {
+		t.Fatalf("expected the reads to be reported together, got %d bytes instead of %d", got, want)
+	}
+}
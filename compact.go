@@ -0,0 +1,414 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/ipfs/go-blockservice/internal"
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+// defaultMinLiveRatio is the MinLiveRatio used when it is not set.
+const defaultMinLiveRatio = 0.5
+
+// CompactionOptions configures a compaction pass.
+type CompactionOptions struct {
+	// MinLiveRatio is the share of live bytes under which a pack with
+	// deleted blocks is compacted. It defaults to 0.5.
+	MinLiveRatio float64
+	// DryRun only reports the packs that would be compacted, without
+	// changing anything.
+	DryRun bool
+}
+
+func (o CompactionOptions) minLiveRatio() float64 {
+	if o.MinLiveRatio <= 0 {
+		return defaultMinLiveRatio
+	}
+	return o.MinLiveRatio
+}
+
+// PackCompaction reports the compaction of a single pack.
+type PackCompaction struct {
+	FileRecordID string
+	// UserID is the owner of the pack, if any.
+	UserID string `json:",omitempty"`
+	// Size is the number of bytes stored in the pack.
+	Size uint64
+	// LiveBytes and LiveBlocks count the blocks of the pack still in the
+	// index, which are copied to the new pack.
+	LiveBytes  uint64
+	LiveBlocks int
+	// NewFileRecordID is the pack the live blocks were copied to. It is
+	// empty in dry-run mode and when no block was live.
+	NewFileRecordID string `json:",omitempty"`
+	// Kept reports that the old pack was left on the uploader, which is
+	// not configured to delete packs. It is deleted by a later pass once it
+	// is.
+	Kept bool `json:",omitempty"`
+	// Err is why the pack could not be compacted, if it failed.
+	Err error `json:"-"`
+}
+
+// CompactionReport is the outcome of a compaction pass.
+type CompactionReport struct {
+	DryRun bool
+	// Packs lists the packs under the live ratio, by decreasing number of
+	// reclaimable bytes.
+	Packs []PackCompaction
+	// Reclaimed is the number of bytes freed, or that would be freed in
+	// dry-run mode.
+	Reclaimed uint64
+}
+
+// ErrCompactionUnsupported is returned by Compact for blockservices that do
+// not store blocks in the uploader CDN.
+var ErrCompactionUnsupported = errors.New("blockservice: compaction needs a CDN backed blockservice")
+
+// Compact copies the live blocks of the packs of bs whose live ratio fell
+// under opts.MinLiveRatio to new packs, points the index at the copies and
+// deletes the old packs, or keeps them if the uploader cannot delete packs,
+// see uploader.WithDeletePath. Packs that fail are reported in the report and
+// skipped, and the returned error counts them.
+//
+// Reads racing with the compaction of a pack may miss the CDN and fall back to
+// the next lookup source.
+func Compact(ctx context.Context, bs BlockService, opts CompactionOptions) (*CompactionReport, error) {
+	s, ok := bs.(*blockService)
+	if !ok || !s.cdnEnabled() {
+		return nil, ErrCompactionUnsupported
+	}
+	return s.compact(ctx, opts)
+}
+
+// compactionBlock is a block found in a pack being compacted.
+type compactionBlock struct {
+	key  string
+	hash mh.Multihash
+	info fileInfo
+}
+
+func (s *blockService) compact(ctx context.Context, opts CompactionOptions) (*CompactionReport, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.compact")
+	defer span.End()
+
+	packs := make(map[string]*PackCompaction)
+	err := s.index.Iterate(ctx, garbagePrefix, func(key string, value []byte) error {
+		id := strings.TrimPrefix(key, garbagePrefix)
+		var g packGarbage
+		if err := json.Unmarshal(value, &g); err != nil {
+			return fmt.Errorf("failed to unmarshal `packGarbage` of %s: %w", id, err)
+		}
+		pr, err := s.getPackRecord(ctx, id)
+		if errors.Is(err, ErrIndexNotFound) {
+			// Packs written before their size was recorded cannot be
+			// rated.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var live uint64
+		if pr.Size > g.Bytes {
+			live = pr.Size - g.Bytes
+		}
+		if pr.Size == 0 || float64(live)/float64(pr.Size) >= opts.minLiveRatio() {
+			return nil
+		}
+		packs[id] = &PackCompaction{FileRecordID: id, UserID: pr.UserID, Size: pr.Size}
+		return nil
+	})
+	if err != nil {
+		return nil, indexError(err)
+	}
+
+	report := &CompactionReport{DryRun: opts.DryRun}
+	if len(packs) == 0 {
+		return report, nil
+	}
+
+	// The index has no listing of the blocks of a pack, collect them in a
+	// single scan.
+	live := make(map[string][]compactionBlock, len(packs))
+	err = IterateBlocks(ctx, s.index, BlockFilter{}, func(e BlockEntry) error {
+		f := e.fileInfo()
+		if pc, ok := packs[f.FileRecordID]; ok {
+			live[f.FileRecordID] = append(live[f.FileRecordID], compactionBlock{blockKey(e.Multihash), e.Multihash, f})
+			pc.LiveBytes += f.Size
+			pc.LiveBlocks++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, indexError(err)
+	}
+
+	var failed int
+	for _, pc := range packs {
+		if !opts.DryRun {
+			if err := s.compactPack(ctx, pc, live[pc.FileRecordID]); err != nil {
+				logger.Errorf("could not compact pack %s: %s", pc.FileRecordID, err)
+				pc.Err = err
+				failed++
+			}
+		}
+		if pc.Err == nil && !pc.Kept {
+			report.Reclaimed += pc.Size - pc.LiveBytes
+		}
+		report.Packs = append(report.Packs, *pc)
+	}
+	sort.Slice(report.Packs, func(i, j int) bool {
+		ri := report.Packs[i].Size - report.Packs[i].LiveBytes
+		rj := report.Packs[j].Size - report.Packs[j].LiveBytes
+		if ri != rj {
+			return ri > rj
+		}
+		return report.Packs[i].FileRecordID < report.Packs[j].FileRecordID
+	})
+	if failed != 0 {
+		return report, fmt.Errorf("failed to compact %d of %d packs", failed, len(packs))
+	}
+	return report, nil
+}
+
+// compactPack copies the blocks of candidates still indexed in pc to a new
+// pack and deletes pc. It runs under the lock of the owner of the pack, which
+// guards its appends, and the lock of the pack, which guards its deletes.
+//
+// The users sharing blocks of pc are accounted for them in the new pack. If
+// the uploader does not confirm the delete of pc, it stays in the index as a
+// pack without live blocks and is deleted by the next pass. If the uploader is
+// not configured to delete packs, pc is kept the same way and reported as
+// such.
+func (s *blockService) compactPack(ctx context.Context, pc *PackCompaction, candidates []compactionBlock) error {
+	ctx, unlock, err := s.userLocker.Lock(ctx, pc.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to lock user %s: %w", pc.UserID, indexError(err))
+	}
+	defer unlock()
+	ctx, unlockPack, err := s.lockPack(ctx, pc.FileRecordID)
+	if err != nil {
+		return err
+	}
+	defer unlockPack()
+	old, err := s.getPackGarbage(ctx, pc.FileRecordID)
+	if err != nil {
+		return err
+	}
+
+	// Blocks may have been deleted since the scan.
+	var blocks []compactionBlock
+	pc.LiveBytes, pc.LiveBlocks = 0, 0
+	for _, b := range candidates {
+		f, err := s.getFileInfo(ctx, b.hash)
+		if errors.Is(err, ErrIndexNotFound) {
+			continue
+		}
+		if err != nil {
+			return indexError(err)
+		}
+		if f != b.info {
+			continue
+		}
+		blocks = append(blocks, b)
+		pc.LiveBytes += f.Size
+		pc.LiveBlocks++
+	}
+
+	var fr fileRecord
+	current := false
+	if pc.UserID != "" {
+		fr, err = s.getFileRecord(ctx, pc.UserID)
+		if err != nil && !errors.Is(err, ErrIndexNotFound) {
+			return err
+		}
+		current = fr.FileRecordID == pc.FileRecordID
+	}
+
+	kvs := make(map[string][]byte, len(blocks)+3)
+	var g packGarbage
+	if len(blocks) != 0 {
+		parts := make([]uploader.Part, len(blocks))
+		for i, b := range blocks {
+			data, err := s.uploaderClient.ReadRange(ctx, pc.FileRecordID, b.info.Offset, b.info.Size)
+			if err != nil {
+				return fmt.Errorf("failed to read block %s: %w", b.key, err)
+			}
+			if err := checkHash(b.hash, data); err != nil {
+				return err
+			}
+			parts[i] = uploader.BytesPart(b.hash.HexString(), data)
+		}
+
+		id, files, size, err := s.uploadFiles(ctx, parts)
+		if err != nil {
+			return err
+		}
+		pc.NewFileRecordID = id
+
+		for _, f := range files {
+			for _, b := range blocks {
+				if strings.Contains(f.Name, b.hash.HexString()) {
+					v, err := json.Marshal(fileInfo{id, f.CompressedSize64, f.Offset})
+					if err != nil {
+						return err
+					}
+					kvs[b.key] = v
+				}
+			}
+		}
+		pr := packRecord{UserID: pc.UserID, Size: size}
+		pb, err := json.Marshal(pr)
+		if err != nil {
+			return err
+		}
+		kvs[packKey(id)] = pb
+
+		// The owners of the blocks do not change, but the bytes they are
+		// accounted for move to the new pack.
+		for _, b := range blocks {
+			owners, err := s.getOwners(ctx, b.key, packRecord{UserID: pc.UserID})
+			if err != nil {
+				return err
+			}
+			g.unref(pc.UserID, pc.UserID, b.info.Size)
+			for _, u := range owners.Users {
+				g.ref(pc.UserID, u, b.info.Size)
+			}
+		}
+		if g.Released != 0 || len(g.Shared) != 0 {
+			gb, err := json.Marshal(g)
+			if err != nil {
+				return err
+			}
+			kvs[garbageKey(id)] = gb
+		}
+		if current {
+			v, err := json.Marshal(fileRecord{id, size, len(files), fr.Created})
+			if err != nil {
+				return err
+			}
+			kvs[userKey(pc.UserID)] = v
+		}
+		if s.pinningClient != nil {
+			if pc.UserID != "" {
+				if err := s.pinningClient.CreateFileRecord(ctx, pc.UserID, id, g.accounted(pc.UserID, pr)); err != nil {
+					return fmt.Errorf("failed to create file record: %w", err)
+				}
+			}
+			for u := range g.Shared {
+				if u == "" {
+					continue
+				}
+				if err := s.pinningClient.CreateFileRecord(ctx, u, id, g.Shared[u]); err != nil {
+					return fmt.Errorf("failed to create file record: %w", err)
+				}
+			}
+		}
+	}
+
+	// Repoint all the blocks, and the owner if they append to the pack, at
+	// once. If the batch is only partly written, blocks are served from
+	// either pack, both of which still exist, and the old pack keeps its
+	// garbage record: the next pass copies the blocks left behind again.
+	if len(kvs) != 0 {
+		if err := s.index.BatchPut(ctx, kvs); err != nil {
+			return indexError(err)
+		}
+	}
+	if current && len(blocks) == 0 {
+		if err := s.index.Delete(ctx, userKey(pc.UserID)); err != nil {
+			return indexError(err)
+		}
+	}
+	if s.pinningClient != nil {
+		users := []string{pc.UserID}
+		for u := range old.Shared {
+			users = append(users, u)
+		}
+		for _, u := range users {
+			if u == "" {
+				continue
+			}
+			if err := s.pinningClient.CreateFileRecord(ctx, u, pc.FileRecordID, 0); err != nil {
+				return fmt.Errorf("failed to update file record: %w", err)
+			}
+		}
+	}
+
+	// The old pack is forgotten only once the uploader confirmed its
+	// delete. Until then it is all garbage, so that the next pass picks it
+	// again and retries.
+	dead, err := json.Marshal(packGarbage{Bytes: pc.Size})
+	if err != nil {
+		return err
+	}
+	if err := s.index.Put(ctx, garbageKey(pc.FileRecordID), dead); err != nil {
+		return indexError(err)
+	}
+	err = s.uploaderClient.Delete(ctx, pc.FileRecordID)
+	if errors.Is(err, uploader.ErrDeleteUnsupported) {
+		logger.Warnf("kept compacted pack %s, the uploader is not configured to delete packs", pc.FileRecordID)
+		pc.Kept = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete pack %s: %w", pc.FileRecordID, uploadError(err))
+	}
+	for _, key := range []string{packKey(pc.FileRecordID), garbageKey(pc.FileRecordID)} {
+		if err := s.index.Delete(ctx, key); err != nil {
+			return indexError(err)
+		}
+	}
+	return nil
+}
+
+// checkHash verifies that data hashes to h.
+func checkHash(h mh.Multihash, data []byte) error {
+	got, err := cid.NewCidV1(cid.Raw, h).Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got.Hash(), h) {
+		return fmt.Errorf("block %s: %w", h.HexString(), ErrHashMismatch)
+	}
+	return nil
+}
+
+// runCompaction compacts the packs every interval until stop is closed.
+func (s *blockService) runCompaction(interval time.Duration, opts CompactionOptions, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		report, err := s.compact(ctx, opts)
+		cancel()
+		if err != nil {
+			logger.Errorf("compaction failed: %s", err)
+		}
+		if report != nil && len(report.Packs) != 0 {
+			logger.Infof("compaction of %d packs reclaimed %d bytes (dry run: %t)", len(report.Packs), report.Reclaimed, report.DryRun)
+		}
+	}
+}
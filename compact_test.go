@@ -0,0 +1,285 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+func TestCompact(t *testing.T) {
+	pin := newRecordingPinning()
+	bserv, up, idx := newCdnBlockService(t, WithPinningClient(pin))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	bs := bgen.Blocks(4)
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs[1:] {
+		if err := bserv.DeleteBlock(ctx, b.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var size, live uint64
+	for _, b := range bs {
+		size += uint64(len(b.RawData()))
+	}
+	live = uint64(len(bs[0].RawData()))
+
+	report, err := Compact(ctx, bserv, CompactionOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || report.Packs[0].FileRecordID != "pack-1" || report.Packs[0].LiveBlocks != 1 {
+		t.Fatalf("unexpected dry-run report %+v", report)
+	}
+	if report.Reclaimed != size-live {
+		t.Fatalf("expected %d reclaimable bytes, got %d", size-live, report.Reclaimed)
+	}
+	if up.Uploads != 1 || up.Deletes != 0 {
+		t.Fatalf("dry run should not change anything, got %d uploads and %d deletes", up.Uploads, up.Deletes)
+	}
+
+	report, err = Compact(ctx, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || report.Packs[0].NewFileRecordID != "pack-2" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if up.Has("pack-1") {
+		t.Fatal("expected the old pack to be deleted")
+	}
+	if _, err := idx.Get(ctx, garbageKey("pack-1")); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the garbage of the old pack to be removed, got %v", err)
+	}
+	if pin.records["alice/pack-1"] != 0 || pin.records["alice/pack-2"] != live {
+		t.Fatalf("unexpected file records %v", pin.records)
+	}
+
+	// The cache would hide reads from the CDN.
+	fresh := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithUploaderClient(up), WithIndex(idx))
+	if _, err := fresh.GetBlock(ctx, bs[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The owner keeps appending to the compacted pack.
+	if err := bserv.AddBlock(ctx, bgen.Next()); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 2 || up.Appends != 1 {
+		t.Fatalf("expected an append to the new pack, got %d uploads and %d appends", up.Uploads, up.Appends)
+	}
+
+	report, err = Compact(ctx, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 0 {
+		t.Fatalf("expected nothing left to compact, got %+v", report)
+	}
+}
+
+func TestCompactSkipsLivePacks(t *testing.T) {
+	bserv, up, _ := newCdnBlockService(t)
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	bs := bgen.Blocks(4)
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.DeleteBlock(ctx, bs[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Compact(ctx, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 0 || up.Deletes != 0 {
+		t.Fatalf("expected a mostly live pack to be kept, got %+v", report)
+	}
+
+	report, err = Compact(ctx, bserv, CompactionOptions{MinLiveRatio: 0.9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || report.Packs[0].LiveBlocks != 3 {
+		t.Fatalf("expected the pack to be compacted under a higher ratio, got %+v", report)
+	}
+}
+
+func TestCompactEmptyPack(t *testing.T) {
+	bserv, up, idx := newCdnBlockService(t)
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bserv.AddBlocks(ctx, []blocks.Block{b}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.DeleteBlock(ctx, b.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Compact(ctx, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || report.Packs[0].NewFileRecordID != "" || up.Uploads != 1 {
+		t.Fatalf("expected the pack to be dropped without a copy, got %+v", report)
+	}
+	if up.Has("pack-1") {
+		t.Fatal("expected the pack to be deleted")
+	}
+	if _, err := idx.Get(ctx, userKey("alice")); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the user to start a new pack, got %v", err)
+	}
+}
+
+// undeletableUploader fails deletes until deletable is set.
+type undeletableUploader struct {
+	*uploader.Mock
+	deletable bool
+}
+
+func (u *undeletableUploader) Delete(ctx context.Context, fileRecordID string) error {
+	if !u.deletable {
+		return &uploader.StatusError{Op: "packDelete", URL: fileRecordID, StatusCode: http.StatusNotFound}
+	}
+	return u.Mock.Delete(ctx, fileRecordID)
+}
+
+func TestCompactRetriesDelete(t *testing.T) {
+	up := &undeletableUploader{Mock: uploader.NewMock()}
+	bserv, _, idx := newCdnBlockService(t, WithUploaderClient(up))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	bs := bgen.Blocks(4)
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs[1:] {
+		if err := bserv.DeleteBlock(ctx, b.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Compact(ctx, bserv, CompactionOptions{})
+	if err == nil || len(report.Packs) != 1 || !errors.Is(report.Packs[0].Err, uploader.ErrNotFound) {
+		t.Fatalf("expected the delete to fail, got %+v, %v", report, err)
+	}
+	// The old pack is still tracked, and the block served from the copy.
+	for _, k := range []string{packKey("pack-1"), garbageKey("pack-1")} {
+		if _, err := idx.Get(ctx, k); err != nil {
+			t.Fatalf("expected %s to be kept, got %v", k, err)
+		}
+	}
+	f, err := bserv.(*blockService).getFileInfo(ctx, bs[0].Cid().Hash())
+	if err != nil || f.FileRecordID != "pack-2" {
+		t.Fatalf("expected the block to be moved to pack-2, got %+v, %v", f, err)
+	}
+
+	up.deletable = true
+	report, err = Compact(ctx, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || report.Packs[0].FileRecordID != "pack-1" || report.Packs[0].LiveBlocks != 0 {
+		t.Fatalf("expected the old pack to be deleted again, got %+v", report)
+	}
+	if up.Has("pack-1") {
+		t.Fatal("expected the old pack to be deleted")
+	}
+	for _, k := range []string{packKey("pack-1"), garbageKey("pack-1")} {
+		if _, err := idx.Get(ctx, k); !errors.Is(err, ErrIndexNotFound) {
+			t.Fatalf("expected %s to be removed, got %v", k, err)
+		}
+	}
+	if !up.Has("pack-2") {
+		t.Fatal("expected the copy to be kept")
+	}
+}
+
+// keepingUploader is not configured to delete packs.
+type keepingUploader struct {
+	*uploader.Mock
+}
+
+func (keepingUploader) Delete(ctx context.Context, fileRecordID string) error {
+	return uploader.ErrDeleteUnsupported
+}
+
+func TestCompactKeepsPacks(t *testing.T) {
+	up := keepingUploader{Mock: uploader.NewMock()}
+	bserv, _, idx := newCdnBlockService(t, WithUploaderClient(up))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	bs := bgen.Blocks(4)
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs[1:] {
+		if err := bserv.DeleteBlock(ctx, b.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Compact(ctx, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || !report.Packs[0].Kept || report.Packs[0].NewFileRecordID != "pack-2" || report.Reclaimed != 0 {
+		t.Fatalf("expected the old pack to be kept, got %+v", report)
+	}
+	if !up.Has("pack-1") {
+		t.Fatal("expected the old pack to be kept on the uploader")
+	}
+	if _, err := idx.Get(ctx, packKey("pack-1")); err != nil {
+		t.Fatalf("expected the old pack to stay tracked, got %v", err)
+	}
+	f, err := bserv.(*blockService).getFileInfo(ctx, bs[0].Cid().Hash())
+	if err != nil || f.FileRecordID != "pack-2" {
+		t.Fatalf("expected the block to be moved to pack-2, got %+v, %v", f, err)
+	}
+}
+
+func TestCompactUnsupported(t *testing.T) {
+	bserv := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil)
+	if _, err := Compact(context.Background(), bserv, CompactionOptions{}); !errors.Is(err, ErrCompactionUnsupported) {
+		t.Fatalf("expected ErrCompactionUnsupported, got %v", err)
+	}
+}
+
+func TestCompactionWorker(t *testing.T) {
+	bserv, up, _ := newCdnBlockService(t, WithCompaction(time.Millisecond, CompactionOptions{}))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bserv.AddBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.DeleteBlock(ctx, b.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for up.Has("pack-1") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the worker to compact the pack")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+var (
+	// ErrIndexUnavailable is matched by errors caused by the index failing to
+	// answer, as opposed to a key missing from it.
+	ErrIndexUnavailable = errors.New("blockservice: index unavailable")
+	// ErrUploaderUnavailable is matched by errors caused by the uploader being
+	// unreachable, throttling or failing on its side. Retrying later may
+	// succeed.
+	ErrUploaderUnavailable = errors.New("blockservice: uploader unavailable")
+	// ErrUploadRejected is matched by errors caused by the uploader refusing
+	// an upload or an append. Retrying the same request will not succeed.
+	ErrUploadRejected = errors.New("blockservice: upload rejected")
+)
+
+// kindError attaches one of the sentinel errors above to the error that
+// caused it, so that callers can match either with errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// indexError classifies an error returned by the index. Missing keys and
+// context errors are returned as is.
+func indexError(err error) error {
+	if err == nil || errors.Is(err, ErrIndexNotFound) || isContextError(err) {
+		return err
+	}
+	return &kindError{ErrIndexUnavailable, err}
+}
+
+// uploadError classifies an error returned by the uploader when storing
+// blocks. Context errors are returned as is. Request timeouts are transient,
+// like throttling and server failures.
+func uploadError(err error) error {
+	if err == nil || isContextError(err) {
+		return err
+	}
+	var se *uploader.StatusError
+	if errors.As(err, &se) && se.StatusCode != http.StatusRequestTimeout &&
+		!errors.Is(err, uploader.ErrThrottled) && !errors.Is(err, uploader.ErrServer) {
+		return &kindError{ErrUploadRejected, err}
+	}
+	return &kindError{ErrUploaderUnavailable, err}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,261 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// packRecord is the index entry of a pack, written along with its blocks.
+type packRecord struct {
+	// UserID is the user the pack is accounted to, if any.
+	UserID string `json:",omitempty"`
+	// Size is the number of bytes stored in the pack.
+	Size uint64
+}
+
+// garbageRange is the range of a pack used by a deleted block.
+type garbageRange struct {
+	Offset uint64
+	Size   uint64
+}
+
+// packGarbage tracks the bytes of a pack that its owner is not accounted for:
+// the ranges no longer referenced by the index, and the blocks the owner
+// deleted but other users still reference. It also accounts the blocks of the
+// pack referenced by other users to them.
+type packGarbage struct {
+	Bytes  uint64
+	Ranges []garbageRange
+	// Released is the number of bytes of the blocks the owner of the pack
+	// no longer references, but other users do.
+	Released uint64 `json:",omitempty"`
+	// Shared maps the users other than the owner of the pack to the number
+	// of bytes of its blocks they reference.
+	Shared map[string]uint64 `json:",omitempty"`
+}
+
+// ref accounts size bytes of a block of the pack owned by owner to userID.
+func (g *packGarbage) ref(owner, userID string, size uint64) {
+	if userID == owner {
+		g.Released = sub(g.Released, size)
+		return
+	}
+	if g.Shared == nil {
+		g.Shared = make(map[string]uint64)
+	}
+	g.Shared[userID] += size
+}
+
+// unref stops accounting size bytes of a block of the pack owned by owner to
+// userID.
+func (g *packGarbage) unref(owner, userID string, size uint64) {
+	if userID == owner {
+		g.Released += size
+		return
+	}
+	if g.Shared[userID] <= size {
+		delete(g.Shared, userID)
+		return
+	}
+	g.Shared[userID] -= size
+}
+
+// collect turns size bytes of a block no user references anymore into
+// garbage.
+func (g *packGarbage) collect(offset, size uint64) {
+	g.Released = sub(g.Released, size)
+	g.Bytes += size
+	g.Ranges = append(g.Ranges, garbageRange{Offset: offset, Size: size})
+}
+
+// accounted returns the number of bytes of the pack described by pr that
+// userID is accounted for.
+func (g packGarbage) accounted(userID string, pr packRecord) uint64 {
+	if userID != pr.UserID {
+		return g.Shared[userID]
+	}
+	return sub(pr.Size, g.Bytes+g.Released)
+}
+
+func sub(a, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
+
+// lockPack takes the lock guarding the accounting of a pack and the owners of
+// its blocks. The lock of a user, if needed, must be taken first.
+func (s *blockService) lockPack(ctx context.Context, fileRecordID string) (context.Context, func(), error) {
+	ctx, unlock, err := s.userLocker.Lock(ctx, packKey(fileRecordID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lock pack %s: %w", fileRecordID, indexError(err))
+	}
+	return ctx, unlock, nil
+}
+
+func (s *blockService) getPackRecord(ctx context.Context, fileRecordID string) (packRecord, error) {
+	var pr packRecord
+	v, err := s.index.Get(ctx, packKey(fileRecordID))
+	if err != nil {
+		return pr, indexError(err)
+	}
+	if err := json.Unmarshal(v, &pr); err != nil {
+		return pr, fmt.Errorf("failed to unmarshal `packRecord`: %w", err)
+	}
+	return pr, nil
+}
+
+func (s *blockService) getPackGarbage(ctx context.Context, fileRecordID string) (packGarbage, error) {
+	var g packGarbage
+	v, err := s.index.Get(ctx, garbageKey(fileRecordID))
+	if errors.Is(err, ErrIndexNotFound) {
+		return g, nil
+	}
+	if err != nil {
+		return g, indexError(err)
+	}
+	if err := json.Unmarshal(v, &g); err != nil {
+		return g, fmt.Errorf("failed to unmarshal `packGarbage`: %w", err)
+	}
+	return g, nil
+}
+
+// deleteBlockCdn stops accounting c to the user of ctx, or to all its owners
+// if ctx has no user. Once no user references it anymore, its index entry is
+// removed and the range it used is recorded as garbage of its pack. The
+// pinning service is told about the bytes of the pack the users are still
+// accounted for. Deleting a block that is not indexed, or not referenced by
+// the user, is not an error.
+func (s *blockService) deleteBlockCdn(ctx context.Context, c cid.Cid) error {
+	userID, _ := ctx.Value("userID").(string)
+	for {
+		f, err := s.getFileInfo(ctx, c.Hash())
+		if errors.Is(err, ErrIndexNotFound) {
+			return nil
+		}
+		if err != nil {
+			return indexError(err)
+		}
+		done, err := s.releaseBlock(ctx, userID, c, f)
+		if err != nil || done {
+			return err
+		}
+		// The block was moved by a compaction, release it from its new
+		// pack.
+	}
+}
+
+// releaseBlock removes userID, or all the owners if userID is empty, from the
+// owners of c, which is stored at f. It returns false if c was moved to another pack in the meantime.
+//
+// Blocks of packs written before their owners were recorded are owned by the
+// user deleting them. The pinning service is only told about such a pack if
+// it is still the current pack of the user, whose record gives its size.
+func (s *blockService) releaseBlock(ctx context.Context, userID string, c cid.Cid, f fileInfo) (bool, error) {
+	ctx, unlock, err := s.lockPack(ctx, f.FileRecordID)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	cur, err := s.getFileInfo(ctx, c.Hash())
+	if errors.Is(err, ErrIndexNotFound) {
+		return true, nil
+	}
+	if err != nil {
+		return false, indexError(err)
+	}
+	if cur != f {
+		return false, nil
+	}
+
+	pr, err := s.getPackRecord(ctx, f.FileRecordID)
+	legacy := errors.Is(err, ErrIndexNotFound)
+	if err != nil && !legacy {
+		return false, err
+	}
+	// The size of a pack written before packs were recorded is only known
+	// from the record of its user, if it is still their current pack.
+	accountable := !legacy
+	if legacy && userID != "" {
+		fr, err := s.getFileRecord(ctx, userID)
+		if err != nil && !errors.Is(err, ErrIndexNotFound) {
+			return false, err
+		}
+		if err == nil && fr.FileRecordID == f.FileRecordID {
+			pr, accountable = packRecord{UserID: userID, Size: fr.Size}, true
+		}
+	}
+	key := blockKey(c.Hash())
+	owners, err := s.getOwners(ctx, key, pr)
+	if err != nil {
+		return false, err
+	}
+	if legacy && userID != "" && owners.remove("") {
+		// Nobody recorded who stored the block, the user deleting it is
+		// taken for its owner.
+		owners.add(userID)
+	}
+	var released []string
+	if userID == "" {
+		// Deletes made outside of any user, by the GC, the pinner or a
+		// PackBlockstore, drop the block for all its owners.
+		released, owners.Users = owners.Users, nil
+	} else if owners.remove(userID) {
+		released = []string{userID}
+	}
+	if len(released) == 0 {
+		return true, nil
+	}
+	g, err := s.getPackGarbage(ctx, f.FileRecordID)
+	if err != nil {
+		return false, err
+	}
+	for _, u := range released {
+		g.unref(pr.UserID, u, f.Size)
+	}
+
+	kvs := make(map[string][]byte, 2)
+	if len(owners.Users) == 0 {
+		g.collect(f.Offset, f.Size)
+	} else {
+		ob, err := json.Marshal(owners)
+		if err != nil {
+			return false, err
+		}
+		kvs[ownersKey(key)] = ob
+	}
+	gb, err := json.Marshal(g)
+	if err != nil {
+		return false, err
+	}
+	kvs[garbageKey(f.FileRecordID)] = gb
+	if err := s.index.BatchPut(ctx, kvs); err != nil {
+		return false, indexError(err)
+	}
+	if len(owners.Users) == 0 {
+		for _, k := range []string{key, ownersKey(key)} {
+			if err := s.index.Delete(ctx, k); err != nil {
+				return false, indexError(err)
+			}
+		}
+	}
+
+	if s.pinningClient != nil && accountable {
+		for _, u := range released {
+			if u == "" {
+				continue
+			}
+			err := s.pinningClient.CreateFileRecord(ctx, u, f.FileRecordID, g.accounted(u, pr))
+			if err != nil {
+				return false, fmt.Errorf("failed to update file record: %w", err)
+			}
+		}
+	}
+	return true, nil
+}
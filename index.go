@@ -0,0 +1,250 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrIndexNotFound is returned by BlockIndex implementations when the
+// requested key is not present in the index.
+var ErrIndexNotFound = errors.New("blockservice: key not found in index")
+
+// BlockIndex is the key-value store mapping multihashes to their location in
+// the uploader packs, and users to the pack they currently append to. Keys
+// are namespaced by kind, for instance blk/ for blocks and user/ for users,
+// see MigrateIndex for indexes written before.
+type BlockIndex interface {
+	// Get returns the value stored under key, or ErrIndexNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Put stores value under key, overwriting any previous value.
+	Put(ctx context.Context, key string, value []byte) error
+
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// BatchGet returns the values stored under keys, in the same order.
+	// Missing keys have a nil value.
+	BatchGet(ctx context.Context, keys []string) ([][]byte, error)
+
+	// BatchPut stores all the given key-value pairs, at once where the
+	// store allows it. Callers must not rely on it being atomic: a failure
+	// may leave part of the pairs stored.
+	BatchPut(ctx context.Context, kvs map[string][]byte) error
+
+	// Iterate calls fn for every key starting with prefix, in no particular
+	// order, and stops at the first error returned by fn. fn is never called
+	// concurrently, so it may update state without locking, even when the
+	// keys are scanned in parallel.
+	Iterate(ctx context.Context, prefix string, fn func(key string, value []byte) error) error
+}
+
+// iterateShards runs scan for the shards 0 to n-1 in parallel, passing it a
+// function calling fn for one key at a time, as BlockIndex.Iterate requires.
+// The first error stops all the scans and is returned.
+func iterateShards(ctx context.Context, n int, scan func(ctx context.Context, i int, fn func(key string, value []byte) error) error, fn func(key string, value []byte) error) error {
+	g, gctx := errgroup.WithContext(ctx)
+	var lk sync.Mutex
+	serial := func(key string, value []byte) error {
+		lk.Lock()
+		defer lk.Unlock()
+		// Another scan failed, stop this one too.
+		if err := gctx.Err(); err != nil {
+			return err
+		}
+		return fn(key, value)
+	}
+	for i := 0; i < n; i++ {
+		i := i
+		g.Go(func() error {
+			return scan(gctx, i, serial)
+		})
+	}
+	return g.Wait()
+}
+
+// Prefixes namespacing the keys of the index.
+const (
+	blockPrefix   = "blk/"
+	userPrefix    = "user/"
+	packPrefix    = "pack/"
+	garbagePrefix = "garbage/"
+	ownersPrefix  = "owners/"
+)
+
+func blockKey(h mh.Multihash) string {
+	return blockPrefix + h.HexString()
+}
+
+func userKey(userID string) string {
+	return userPrefix + userID
+}
+
+func packKey(fileRecordID string) string {
+	return packPrefix + fileRecordID
+}
+
+func garbageKey(fileRecordID string) string {
+	return garbagePrefix + fileRecordID
+}
+
+// ownersKey is the key of the owners of the block indexed under key.
+func ownersKey(key string) string {
+	return ownersPrefix + strings.TrimPrefix(key, blockPrefix)
+}
+
+func lockKey(userID string) string {
+	return "lock/" + userID
+}
+
+func (s *blockService) getFileInfo(ctx context.Context, h mh.Multihash) (fileInfo, error) {
+	var f fileInfo
+	v, err := s.index.Get(ctx, blockKey(h))
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(v, &f); err != nil {
+		return f, fmt.Errorf("failed to unmarshal `fileInfo`: %w", err)
+	}
+	return f, nil
+}
+
+func (s *blockService) getFileRecord(ctx context.Context, userID string) (fileRecord, error) {
+	var fr fileRecord
+	v, err := s.index.Get(ctx, userKey(userID))
+	if err != nil {
+		return fr, indexError(err)
+	}
+	if err := json.Unmarshal(v, &fr); err != nil {
+		return fr, fmt.Errorf("failed to unmarshal `fileRecord`: %w", err)
+	}
+	return fr, nil
+}
+
+func (s *blockService) putFileRecord(ctx context.Context, userID string, fr fileRecord) error {
+	bf, err := json.Marshal(fr)
+	if err != nil {
+		return fmt.Errorf("failed to marshal `fileRecord`: %w", err)
+	}
+	return indexError(s.index.Put(ctx, userKey(userID), bf))
+}
+
+// BlockEntry is the location of a block in the packs.
+type BlockEntry struct {
+	Multihash    mh.Multihash
+	FileRecordID string
+	Offset       uint64
+	Size         uint64
+}
+
+func (e BlockEntry) fileInfo() fileInfo {
+	return fileInfo{e.FileRecordID, e.Size, e.Offset}
+}
+
+// BlockFilter restricts the blocks listed by IterateBlocks. Empty fields
+// match all the blocks.
+type BlockFilter struct {
+	// UserID only matches the blocks referenced by the user.
+	UserID string
+	// FileRecordID only matches the blocks stored in the pack.
+	FileRecordID string
+}
+
+// IterateBlocks calls fn for every block of index matching filter, in no
+// particular order, and stops at the first error returned by fn. It scans the
+// whole block namespace, on every master of a Redis cluster.
+func IterateBlocks(ctx context.Context, index BlockIndex, filter BlockFilter, fn func(BlockEntry) error) error {
+	var batch []BlockEntry
+	owners := make(map[string]string)
+	flush := func() error {
+		if filter.UserID != "" {
+			var err error
+			batch, err = filterOwned(ctx, index, filter.UserID, batch, owners)
+			if err != nil {
+				return err
+			}
+		}
+		for _, e := range batch {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := index.Iterate(ctx, blockPrefix, func(key string, value []byte) error {
+		h, err := mh.FromHexString(strings.TrimPrefix(key, blockPrefix))
+		if err != nil {
+			return nil // Not a block entry
+		}
+		var f fileInfo
+		if err := json.Unmarshal(value, &f); err != nil || f.FileRecordID == "" {
+			return nil
+		}
+		if filter.FileRecordID != "" && f.FileRecordID != filter.FileRecordID {
+			return nil
+		}
+		batch = append(batch, BlockEntry{h, f.FileRecordID, f.Offset, f.Size})
+		if len(batch) < indexBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// filterOwned returns the entries of batch referenced by userID. packOwners
+// caches the owners of the packs, which own the blocks indexed before their
+// owners were recorded.
+func filterOwned(ctx context.Context, index BlockIndex, userID string, batch []BlockEntry, packOwners map[string]string) ([]BlockEntry, error) {
+	keys := make([]string, len(batch))
+	for i, e := range batch {
+		keys[i] = ownersKey(blockKey(e.Multihash))
+	}
+	values, err := index.BatchGet(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := batch[:0]
+	for i, e := range batch {
+		var pr packRecord
+		if values[i] == nil {
+			owner, ok := packOwners[e.FileRecordID]
+			if !ok {
+				v, err := index.Get(ctx, packKey(e.FileRecordID))
+				if err != nil && !errors.Is(err, ErrIndexNotFound) {
+					return nil, err
+				}
+				if v != nil {
+					if err := json.Unmarshal(v, &pr); err != nil {
+						return nil, fmt.Errorf("failed to unmarshal `packRecord`: %w", err)
+					}
+				}
+				owner = pr.UserID
+				packOwners[e.FileRecordID] = owner
+			}
+			pr.UserID = owner
+		}
+		o, err := parseOwners(values[i], pr)
+		if err != nil {
+			return nil, err
+		}
+		if i := sort.SearchStrings(o.Users, userID); i < len(o.Users) && o.Users[i] == userID {
+			owned = append(owned, e)
+		}
+	}
+	return owned, nil
+}
@@ -0,0 +1,88 @@
+package blockservice
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+type memoryIndex struct {
+	lk sync.RWMutex
+	kv map[string][]byte
+}
+
+// NewMemoryIndex returns a BlockIndex kept in process memory. It is meant for
+// tests and single-process setups where the index does not need to survive
+// a restart.
+func NewMemoryIndex() BlockIndex {
+	return &memoryIndex{kv: make(map[string][]byte)}
+}
+
+func (m *memoryIndex) Get(ctx context.Context, key string) ([]byte, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+	v, ok := m.kv[key]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (m *memoryIndex) Put(ctx context.Context, key string, value []byte) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.kv[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryIndex) Delete(ctx context.Context, key string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	delete(m.kv, key)
+	return nil
+}
+
+func (m *memoryIndex) BatchGet(ctx context.Context, keys []string) ([][]byte, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+	out := make([][]byte, len(keys))
+	for i, k := range keys {
+		if v, ok := m.kv[k]; ok {
+			out[i] = append([]byte(nil), v...)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryIndex) BatchPut(ctx context.Context, kvs map[string][]byte) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for k, v := range kvs {
+		m.kv[k] = append([]byte(nil), v...)
+	}
+	return nil
+}
+
+func (m *memoryIndex) Iterate(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	// Copy the matching pairs so that fn may call back into the index.
+	m.lk.RLock()
+	var keys []string
+	var values [][]byte
+	for k, v := range m.kv {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+			values = append(values, append([]byte(nil), v...))
+		}
+	}
+	m.lk.RUnlock()
+
+	for i, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(k, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
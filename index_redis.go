@@ -0,0 +1,127 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scanCount is the COUNT hint passed to SCAN when iterating over the index.
+const scanCount = 1000
+
+type redisIndex struct {
+	rdb redis.UniversalClient
+}
+
+// NewRedisIndex returns a BlockIndex stored in Redis. Batched operations are
+// pipelined, which the cluster client splits per hash slot.
+func NewRedisIndex(rdb redis.UniversalClient) BlockIndex {
+	return &redisIndex{rdb: rdb}
+}
+
+func (r *redisIndex) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := r.rdb.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrIndexNotFound
+	}
+	return v, err
+}
+
+func (r *redisIndex) Put(ctx context.Context, key string, value []byte) error {
+	return r.rdb.Set(ctx, key, value, 0).Err()
+}
+
+func (r *redisIndex) Delete(ctx context.Context, key string) error {
+	return r.rdb.Del(ctx, key).Err()
+}
+
+func (r *redisIndex) BatchGet(ctx context.Context, keys []string) ([][]byte, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = p.Get(ctx, k)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	out := make([][]byte, len(keys))
+	for i, cmd := range cmds {
+		v, err := cmd.Bytes()
+		switch {
+		case err == nil:
+			out[i] = v
+		case !errors.Is(err, redis.Nil):
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// BatchPut writes kvs in a MULTI/EXEC transaction. A cluster runs one
+// transaction per hash slot, so the keys of different slots may be written
+// apart.
+func (r *redisIndex) BatchPut(ctx context.Context, kvs map[string][]byte) error {
+	_, err := r.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		for k, v := range kvs {
+			p.Set(ctx, k, v, 0)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisIndex) Iterate(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	cluster, ok := r.rdb.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, r.rdb, prefix, fn)
+	}
+
+	// Keys are spread over the masters, each of them has to be scanned.
+	// ForEachMaster calls back concurrently, collect the masters first.
+	var lk sync.Mutex
+	var masters []*redis.Client
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		lk.Lock()
+		defer lk.Unlock()
+		masters = append(masters, node)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return iterateShards(ctx, len(masters), func(ctx context.Context, i int, fn func(key string, value []byte) error) error {
+		return scanNode(ctx, masters[i], prefix, fn)
+	}, fn)
+}
+
+func scanNode(ctx context.Context, c redis.Cmdable, prefix string, fn func(key string, value []byte) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(ctx, cursor, prefix+"*", scanCount).Result()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			v, err := c.Get(ctx, k).Bytes()
+			if errors.Is(err, redis.Nil) {
+				// Deleted since the scan returned it.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,190 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"testing"
+
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+)
+
+func TestMemoryIndex(t *testing.T) {
+	testBlockIndex(t, NewMemoryIndex())
+}
+
+// shardedIndex spreads keys over several memory indexes and scans them in
+// parallel, the way a Redis cluster index does.
+type shardedIndex struct {
+	shards []BlockIndex
+}
+
+func newShardedIndex(n int) *shardedIndex {
+	s := &shardedIndex{}
+	for i := 0; i < n; i++ {
+		s.shards = append(s.shards, NewMemoryIndex())
+	}
+	return s
+}
+
+func (s *shardedIndex) shard(key string) BlockIndex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *shardedIndex) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.shard(key).Get(ctx, key)
+}
+
+func (s *shardedIndex) Put(ctx context.Context, key string, value []byte) error {
+	return s.shard(key).Put(ctx, key, value)
+}
+
+func (s *shardedIndex) Delete(ctx context.Context, key string) error {
+	return s.shard(key).Delete(ctx, key)
+}
+
+func (s *shardedIndex) BatchGet(ctx context.Context, keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		v, err := s.Get(ctx, key)
+		if err != nil && !errors.Is(err, ErrIndexNotFound) {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func (s *shardedIndex) BatchPut(ctx context.Context, values map[string][]byte) error {
+	for key, v := range values {
+		if err := s.Put(ctx, key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedIndex) Iterate(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	return iterateShards(ctx, len(s.shards), func(ctx context.Context, i int, fn func(key string, value []byte) error) error {
+		return s.shards[i].Iterate(ctx, prefix, fn)
+	}, fn)
+}
+
+func TestShardedIndex(t *testing.T) {
+	testBlockIndex(t, newShardedIndex(4))
+}
+
+func TestShardedIndexCallers(t *testing.T) {
+	idx := newShardedIndex(4)
+	bserv, _, _ := newCdnBlockService(t, WithIndex(idx))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	bs := bgen.Blocks(64)
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	err := IterateBlocks(ctx, idx, BlockFilter{UserID: "alice"}, func(BlockEntry) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(bs) {
+		t.Fatalf("expected %d blocks, got %d", len(bs), n)
+	}
+
+	for _, b := range bs[1:] {
+		if err := bserv.DeleteBlock(ctx, b.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := Compact(ctx, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || report.Packs[0].LiveBlocks != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, err := MigrateIndex(ctx, idx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testBlockIndex checks the BlockIndex contract against idx, which must be
+// empty.
+func testBlockIndex(t *testing.T, idx BlockIndex) {
+	ctx := context.Background()
+
+	if _, err := idx.Get(ctx, "missing"); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected ErrIndexNotFound, got %v", err)
+	}
+
+	if err := idx.Put(ctx, "a/1", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := idx.Get(ctx, "a/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "one" {
+		t.Fatalf("unexpected value %q", v)
+	}
+
+	err = idx.BatchPut(ctx, map[string][]byte{
+		"a/2": []byte("two"),
+		"b/3": []byte("three"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vs, err := idx.BatchGet(ctx, []string{"b/3", "missing", "a/1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 3 || string(vs[0]) != "three" || vs[1] != nil || string(vs[2]) != "one" {
+		t.Fatalf("unexpected batch values %q", vs)
+	}
+
+	var keys []string
+	err = idx.Iterate(ctx, "a/", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a/1" || keys[1] != "a/2" {
+		t.Fatalf("unexpected iterated keys %v", keys)
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	err = idx.Iterate(ctx, "", func(key string, value []byte) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("expected iteration to stop with the callback error, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected iteration to stop after the first error, got %d calls", calls)
+	}
+
+	if err := idx.Delete(ctx, "a/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Delete(ctx, "a/1"); err != nil {
+		t.Fatalf("deleting a missing key should succeed, got %v", err)
+	}
+	if _, err := idx.Get(ctx, "a/1"); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected ErrIndexNotFound after delete, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package blockservice
+
+import (
+	"context"
+
+	"github.com/ipfs/go-blockservice/tikv"
+)
+
+type tikvIndex struct {
+	client *tikv.Client
+}
+
+// NewTiKVIndex returns a BlockIndex stored in TiKV. Batched writes are
+// committed in a single transaction.
+func NewTiKVIndex(client *tikv.Client) BlockIndex {
+	return &tikvIndex{client: client}
+}
+
+func (t *tikvIndex) Get(ctx context.Context, key string) ([]byte, error) {
+	kv, err := t.client.Get(ctx, []byte(key))
+	if tikv.IsNotFound(err) {
+		return nil, ErrIndexNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kv.V, nil
+}
+
+func (t *tikvIndex) Put(ctx context.Context, key string, value []byte) error {
+	return t.client.Puts(ctx, []byte(key), value)
+}
+
+func (t *tikvIndex) Delete(ctx context.Context, key string) error {
+	return t.client.Dels(ctx, []byte(key))
+}
+
+func (t *tikvIndex) BatchGet(ctx context.Context, keys []string) ([][]byte, error) {
+	bkeys := make([][]byte, len(keys))
+	for i, k := range keys {
+		bkeys[i] = []byte(k)
+	}
+	found, err := t.client.BatchGet(ctx, bkeys...)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(keys))
+	for i, k := range keys {
+		out[i] = found[k]
+	}
+	return out, nil
+}
+
+func (t *tikvIndex) BatchPut(ctx context.Context, kvs map[string][]byte) error {
+	args := make([][]byte, 0, 2*len(kvs))
+	for k, v := range kvs {
+		args = append(args, []byte(k), v)
+	}
+	return t.client.Puts(ctx, args...)
+}
+
+func (t *tikvIndex) Iterate(ctx context.Context, prefix string, fn func(key string, value []byte) error) error {
+	return t.client.Iter(ctx, []byte(prefix), func(kv tikv.KV) error {
+		return fn(string(kv.K), kv.V)
+	})
+}
@@ -0,0 +1,416 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-blockservice/retry"
+)
+
+// JournalEntry records the index writes and pinning service notification
+// owed for blocks the uploader has accepted. Applying an entry several times
+// has the same effect as applying it once.
+//
+// Before the upload, the entry only records the intent of the write: Intent
+// is set, Record is the pack appended to, if any, and Keys lists the blocks.
+// Nothing tells where the blocks of an interrupted write landed, if anywhere,
+// so its intent is kept until an operator checks the upload sent with its
+// IdempotencyKey and deletes the entry from the journal.
+type JournalEntry struct {
+	ID string
+	// UserID is the user who added the blocks, if any.
+	UserID string `json:",omitempty"`
+	// Record is the pack the blocks were written to, as it was after the
+	// write.
+	Record PackInfo
+	// Blocks maps the index keys of the written blocks to their index
+	// entries.
+	Blocks map[string][]byte
+	// Time is when the entry was created.
+	Time time.Time
+
+	// Intent marks an entry recorded before the upload.
+	Intent bool `json:",omitempty"`
+	// Keys lists the index keys of the blocks of an intent.
+	Keys []string `json:",omitempty"`
+	// IdempotencyKey is the key the upload of an intent is sent with, so
+	// that the uploader can tell which upload a crash interrupted.
+	IdempotencyKey string `json:",omitempty"`
+}
+
+// Journal is a write-ahead log of the pack writes the index does not reflect
+// yet. Entries are added as intents before a pack is uploaded or appended to,
+// completed once the uploader accepted the write, and removed once the index
+// and the pinning service are up to date. Pending entries are replayed in the
+// background while a blockservice runs.
+type Journal interface {
+	// Put durably records e.
+	Put(ctx context.Context, e JournalEntry) error
+
+	// Delete removes the entry with the given ID. Deleting a missing entry
+	// is not an error.
+	Delete(ctx context.Context, id string) error
+
+	// Pending returns the entries that were not deleted, in no particular
+	// order.
+	Pending(ctx context.Context) ([]JournalEntry, error)
+}
+
+const (
+	// journalReplayInterval is how often the journal is replayed.
+	journalReplayInterval = time.Minute
+	// journalReplayTimeout bounds a replay of the journal. Entries that
+	// could not be replayed are kept for the next time.
+	journalReplayTimeout = time.Minute
+	// journalIntentAge is the age past which an intent is taken for the
+	// leftover of an interrupted upload rather than an upload in progress,
+	// and reported.
+	journalIntentAge = time.Hour
+)
+
+type fileJournal struct {
+	dir string
+}
+
+// NewFileJournal returns a Journal keeping each entry in a file of dir, which
+// is created if needed. It only protects against crashes of a gateway that
+// restarts with the same dir.
+func NewFileJournal(dir string) (Journal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	return &fileJournal{dir: dir}, nil
+}
+
+func (j *fileJournal) path(id string) string {
+	return filepath.Join(j.dir, id+".json")
+}
+
+func (j *fileJournal) Put(ctx context.Context, e JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(j.dir, "entry-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path(e.ID)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(j.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (j *fileJournal) Delete(ctx context.Context, id string) error {
+	err := os.Remove(j.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (j *fileJournal) Pending(ctx context.Context) ([]JournalEntry, error) {
+	names, err := filepath.Glob(filepath.Join(j.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]JournalEntry, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("invalid journal entry %s: %w", name, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// journalPrefix is the prefix of the journal entries kept in a BlockIndex.
+const journalPrefix = "journal/"
+
+type indexJournal struct {
+	index BlockIndex
+}
+
+// NewIndexJournal returns a Journal kept in index, for instance a TiKV index
+// shared by all the gateways so that any of them can replay the entries of
+// the others.
+func NewIndexJournal(index BlockIndex) Journal {
+	return &indexJournal{index: index}
+}
+
+func (j *indexJournal) Put(ctx context.Context, e JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return j.index.Put(ctx, journalPrefix+e.ID, data)
+}
+
+func (j *indexJournal) Delete(ctx context.Context, id string) error {
+	return j.index.Delete(ctx, journalPrefix+id)
+}
+
+func (j *indexJournal) Pending(ctx context.Context) ([]JournalEntry, error) {
+	var entries []JournalEntry
+	err := j.index.Iterate(ctx, journalPrefix, func(key string, value []byte) error {
+		var e JournalEntry
+		if err := json.Unmarshal(value, &e); err != nil {
+			return fmt.Errorf("invalid journal entry %s: %w", strings.TrimPrefix(key, journalPrefix), err)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// journalIntent records the intent of a write of keys by userID to the pack
+// described by fr before it is uploaded, and returns a context carrying the
+// idempotency key of the upload. It does nothing without a journal.
+func (s *blockService) journalIntent(ctx context.Context, id, userID string, fr fileRecord, keys []string) (context.Context, error) {
+	if s.journal == nil {
+		return ctx, nil
+	}
+	key, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	e := JournalEntry{
+		ID:             id,
+		UserID:         userID,
+		Record:         fr.packInfo(),
+		Time:           time.Now(),
+		Intent:         true,
+		Keys:           keys,
+		IdempotencyKey: key,
+	}
+	if err := s.journal.Put(ctx, e); err != nil {
+		return nil, fmt.Errorf("failed to journal the write of %d blocks: %w", len(keys), err)
+	}
+	return retry.WithKey(ctx, key), nil
+}
+
+// dropIntent removes the intent id of a write that failed.
+func (s *blockService) dropIntent(ctx context.Context, id string) {
+	if s.journal == nil {
+		return
+	}
+	if err := s.journal.Delete(ctx, id); err != nil {
+		logger.Errorf("could not remove journal entry %s: %s", id, err)
+	}
+}
+
+// commitPackWrite brings the index and the pinning service up to date with a
+// pack write. The write is journaled first, so that it is completed by the
+// next replay if the process dies half way.
+func (s *blockService) commitPackWrite(ctx context.Context, e JournalEntry) error {
+	if s.journal != nil {
+		e.Time = time.Now()
+		if err := s.journal.Put(ctx, e); err != nil {
+			return fmt.Errorf("failed to journal the write to %s: %w", e.Record.FileRecordID, err)
+		}
+	}
+	if err := s.applyPackWrite(ctx, e, false); err != nil {
+		return err
+	}
+	if s.journal != nil {
+		if err := s.journal.Delete(ctx, e.ID); err != nil {
+			logger.Errorf("could not remove journal entry %s: %s", e.ID, err)
+		}
+	}
+	return nil
+}
+
+// applyPackWrite notifies the pinning service of the bytes of the pack the
+// user is accounted for, then updates the record of the user, the record of
+// the pack and the index entries and owners of the written blocks.
+//
+// When replaying, the user lock is taken and the record of the user is only
+// updated if it does not already point to a newer pack, or to a larger size
+// of the same one.
+func (s *blockService) applyPackWrite(ctx context.Context, e JournalEntry, replay bool) error {
+	if replay && e.UserID != "" {
+		var (
+			unlock func()
+			err    error
+		)
+		ctx, unlock, err = s.userLocker.Lock(ctx, e.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to lock user %s: %w", e.UserID, indexError(err))
+		}
+		defer unlock()
+	}
+	ctx, unlock, err := s.lockPack(ctx, e.Record.FileRecordID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	pr := packRecord{UserID: e.UserID, Size: e.Record.Size}
+	if e.UserID != "" {
+		if s.pinningClient != nil {
+			g, err := s.getPackGarbage(ctx, e.Record.FileRecordID)
+			if err != nil {
+				return err
+			}
+			err = s.pinningClient.CreateFileRecord(ctx, e.UserID, e.Record.FileRecordID, g.accounted(e.UserID, pr))
+			if err != nil {
+				return fmt.Errorf("failed to create file record: %w", err)
+			}
+		}
+
+		update := true
+		if replay {
+			cur, err := s.getFileRecord(ctx, e.UserID)
+			switch {
+			case errors.Is(err, ErrIndexNotFound):
+			case err != nil:
+				return err
+			case cur.FileRecordID == e.Record.FileRecordID:
+				update = cur.Size < e.Record.Size
+			default:
+				update = cur.Created.Before(e.Record.Created)
+			}
+		}
+		if update {
+			if err := s.putFileRecord(ctx, e.UserID, fileRecord(e.Record)); err != nil {
+				return fmt.Errorf("failed to put data in index: %w", err)
+			}
+		}
+	}
+
+	kvs := make(map[string][]byte, 2*len(e.Blocks)+1)
+	okeys := make([]string, 0, len(e.Blocks))
+	for k, v := range e.Blocks {
+		kvs[k] = v
+		okeys = append(okeys, ownersKey(k))
+	}
+	// New blocks are owned by the user writing them, unless they were
+	// claimed since the write.
+	owners, err := s.index.BatchGet(ctx, okeys)
+	if err != nil {
+		return indexError(err)
+	}
+	ob, err := json.Marshal(blockOwners{Users: []string{e.UserID}})
+	if err != nil {
+		return err
+	}
+	for i, k := range okeys {
+		if owners[i] == nil {
+			kvs[k] = ob
+		}
+	}
+	pb, err := json.Marshal(pr)
+	if err != nil {
+		return err
+	}
+	kvs[packKey(e.Record.FileRecordID)] = pb
+	if err := s.index.BatchPut(ctx, kvs); err != nil {
+		return indexError(err)
+	}
+	return nil
+}
+
+// replayJournal applies the pending journal entries, oldest first, and
+// removes them. Entries that fail are kept, as are the intents, which are
+// reported once they are old enough to belong to interrupted writes.
+func (s *blockService) replayJournal(ctx context.Context) error {
+	entries, err := s.journal.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+
+	var failed, interrupted int
+	for _, e := range entries {
+		if e.Intent {
+			// The upload may still be in progress.
+			if time.Since(e.Time) < journalIntentAge {
+				continue
+			}
+			logger.Errorf("journal entry %s: the write of %d blocks of user %q after pack %q was interrupted, check the upload with idempotency key %s and delete the entry",
+				e.ID, len(e.Keys), e.UserID, e.Record.FileRecordID, e.IdempotencyKey)
+			interrupted++
+			continue
+		}
+		if err := s.applyPackWrite(ctx, e, true); err != nil {
+			logger.Errorf("could not replay journal entry %s: %s", e.ID, err)
+			failed++
+			continue
+		}
+		if err := s.journal.Delete(ctx, e.ID); err != nil {
+			logger.Errorf("could not remove journal entry %s: %s", e.ID, err)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to replay %d of %d journal entries", failed, len(entries))
+	}
+	if interrupted != 0 {
+		return fmt.Errorf("%d interrupted writes are left in the journal", interrupted)
+	}
+	return nil
+}
+
+// runJournalReplay replays the journal now and every interval until stop is
+// closed.
+func (s *blockService) runJournalReplay(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), journalReplayTimeout)
+		go func() {
+			select {
+			case <-stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if err := s.replayJournal(ctx); err != nil {
+			logger.Errorf("could not replay the upload journal: %s", err)
+		}
+		cancel()
+
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
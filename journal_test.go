@@ -0,0 +1,247 @@
+package blockservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+func TestJournals(t *testing.T) {
+	fj, err := NewFileJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, j := range map[string]Journal{
+		"file":  fj,
+		"index": NewIndexJournal(NewMemoryIndex()),
+	} {
+		ctx := context.Background()
+		for _, id := range []string{"a", "b"} {
+			e := JournalEntry{ID: id, UserID: "alice", Blocks: map[string][]byte{id: []byte("{}")}}
+			if err := j.Put(ctx, e); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+		}
+		if err := j.Delete(ctx, "a"); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if err := j.Delete(ctx, "missing"); err != nil {
+			t.Fatalf("%s: deleting a missing entry: %s", name, err)
+		}
+		pending, err := j.Pending(ctx)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(pending) != 1 || pending[0].ID != "b" || !bytes.Equal(pending[0].Blocks["b"], []byte("{}")) {
+			t.Fatalf("%s: unexpected pending entries %+v", name, pending)
+		}
+	}
+}
+
+// crashingIndex fails block index writes, as if the process died before
+// them.
+type crashingIndex struct {
+	BlockIndex
+}
+
+func (ci *crashingIndex) BatchPut(ctx context.Context, kvs map[string][]byte) error {
+	return errors.New("crashed")
+}
+
+func TestJournalReplay(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	up := uploader.NewMock()
+	idx := NewMemoryIndex()
+	journal, err := NewFileJournal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newService := func(idx BlockIndex, pin *recordingPinning) BlockService {
+		return New(
+			blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil,
+			WithUploaderClient(up), WithIndex(idx), WithPinningClient(pin), WithJournal(journal),
+		)
+	}
+
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	crashed := newService(&crashingIndex{idx}, newRecordingPinning())
+	if err := crashed.AddBlock(ctx, block); err == nil {
+		t.Fatal("expected the add to fail")
+	}
+	if pending, _ := journal.Pending(ctx); len(pending) != 1 {
+		t.Fatalf("expected the write to stay journaled, got %d entries", len(pending))
+	}
+	if _, err := idx.Get(ctx, blockKey(block.Cid().Hash())); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the block not to be indexed, got %v", err)
+	}
+
+	if err := crashed.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The journal is replayed in the background.
+	pin := newRecordingPinning()
+	bserv := newService(idx, pin)
+	defer bserv.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := journal.Pending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the journal to be replayed, got %d entries", len(pending))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	got, err := bserv.GetBlock(ctx, block.Cid())
+	if err != nil {
+		t.Fatalf("expected the block to be readable after replay: %s", err)
+	}
+	if !bytes.Equal(got.RawData(), block.RawData()) {
+		t.Fatal("block data is not equal")
+	}
+	if pin.records["alice/pack-1"] != uint64(len(block.RawData())) {
+		t.Fatalf("expected the file record to be created on replay, got %v", pin.records)
+	}
+}
+
+// intentCheckingUploader checks that writes are journaled before being
+// uploaded.
+type intentCheckingUploader struct {
+	*uploader.Mock
+	journal Journal
+	intents int
+}
+
+func (u *intentCheckingUploader) Upload(ctx context.Context, parts []uploader.Part) (*uploader.PackResponse, error) {
+	pending, err := u.journal.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range pending {
+		if e.Intent && e.UserID == "alice" && len(e.Keys) == len(parts) && e.IdempotencyKey != "" {
+			u.intents++
+		}
+	}
+	return u.Mock.Upload(ctx, parts)
+}
+
+func TestJournalIntent(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	journal := NewIndexJournal(NewMemoryIndex())
+	up := &intentCheckingUploader{Mock: uploader.NewMock(), journal: journal}
+	bserv, _, _ := newCdnBlockService(t, WithUploaderClient(up), WithJournal(journal))
+	defer bserv.Close()
+
+	bgen := butil.NewBlockGenerator()
+	if err := bserv.AddBlocks(ctx, bgen.Blocks(2)); err != nil {
+		t.Fatal(err)
+	}
+	if up.intents != 1 {
+		t.Fatalf("expected the write to be journaled before the upload, got %d intents", up.intents)
+	}
+	if pending, _ := journal.Pending(ctx); len(pending) != 0 {
+		t.Fatalf("expected the journal to be empty, got %d entries", len(pending))
+	}
+
+	// Failed uploads do not leave their intent behind.
+	failing, _, _ := newCdnBlockService(t, WithUploaderClient(&flakyUploader{Mock: uploader.NewMock()}), WithJournal(journal))
+	defer failing.Close()
+	if err := failing.AddBlock(ctx, bgen.Next()); err == nil {
+		t.Fatal("expected the add to fail")
+	}
+	if pending, _ := journal.Pending(ctx); len(pending) != 0 {
+		t.Fatalf("expected the intent to be removed, got %d entries", len(pending))
+	}
+}
+
+func TestJournalReplayIntents(t *testing.T) {
+	ctx := context.Background()
+	journal := NewIndexJournal(NewMemoryIndex())
+	bserv, _, _ := newCdnBlockService(t)
+	s := bserv.(*blockService)
+	s.journal = journal
+
+	now := time.Now()
+	for _, e := range []JournalEntry{
+		{ID: "interrupted", UserID: "alice", Time: now.Add(-2 * journalIntentAge), Intent: true, Keys: []string{"k1"}},
+		{ID: "in-progress", UserID: "alice", Time: now, Intent: true, Keys: []string{"k2"}},
+	} {
+		if err := journal.Put(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.replayJournal(ctx); err == nil {
+		t.Fatal("expected the interrupted write to be reported")
+	}
+	pending, err := journal.Pending(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("expected the intents to be kept, got %+v", pending)
+	}
+
+	// Once resolved, nothing is left to report.
+	if err := journal.Delete(ctx, "interrupted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.replayJournal(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJournalReplayKeepsNewerRecord(t *testing.T) {
+	ctx := context.Background()
+	bserv, _, idx := newCdnBlockService(t)
+	s := bserv.(*blockService)
+
+	now := time.Now()
+	newer := fileRecord{FileRecordID: "pack-2", Size: 10, Created: now}
+	if err := s.putFileRecord(ctx, "alice", newer); err != nil {
+		t.Fatal(err)
+	}
+	stale := []JournalEntry{
+		{ID: "old-pack", UserID: "alice", Record: PackInfo{FileRecordID: "pack-1", Size: 100, Created: now.Add(-time.Hour)}, Blocks: map[string][]byte{"k1": []byte("{}")}},
+		{ID: "same-pack", UserID: "alice", Record: PackInfo{FileRecordID: "pack-2", Size: 5, Created: now}, Blocks: map[string][]byte{"k2": []byte("{}")}},
+	}
+	for _, e := range stale {
+		if err := s.applyPackWrite(ctx, e, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr, err := s.getFileRecord(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.FileRecordID != "pack-2" || fr.Size != 10 {
+		t.Fatalf("expected the newer record to be kept, got %+v", fr)
+	}
+	for _, k := range []string{"k1", "k2"} {
+		if _, err := idx.Get(ctx, k); err != nil {
+			t.Fatalf("expected %s to be indexed: %s", k, err)
+		}
+	}
+
+	grown := JournalEntry{ID: "grown", UserID: "alice", Record: PackInfo{FileRecordID: "pack-2", Size: 20, Created: now}}
+	if err := s.applyPackWrite(ctx, grown, true); err != nil {
+		t.Fatal(err)
+	}
+	if fr, _ := s.getFileRecord(ctx, "alice"); fr.Size != 20 {
+		t.Fatalf("expected the record to grow, got %+v", fr)
+	}
+}
@@ -0,0 +1,187 @@
+package blockservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// UserLocker serializes the updates of the pack a user appends to, so that
+// concurrent adds for the same user neither append to a stale pack nor roll
+// over to several new ones.
+type UserLocker interface {
+	// Lock blocks until the caller holds the lock of userID, or ctx is done.
+	// The returned function releases the lock. The returned context is
+	// derived from ctx and canceled once the lock is released or lost, the
+	// work done under the lock must use it so that it stops with the lock.
+	Lock(ctx context.Context, userID string) (lctx context.Context, unlock func(), err error)
+}
+
+type localUserLocker struct {
+	lk    sync.Mutex
+	locks map[string]*localLock
+}
+
+type localLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// NewLocalUserLocker returns a UserLocker serializing the adds of a single
+// process. It is the default, and is enough when one gateway owns the index.
+func NewLocalUserLocker() UserLocker {
+	return &localUserLocker{locks: make(map[string]*localLock)}
+}
+
+func (l *localUserLocker) Lock(ctx context.Context, userID string) (context.Context, func(), error) {
+	l.lk.Lock()
+	ul, ok := l.locks[userID]
+	if !ok {
+		ul = &localLock{ch: make(chan struct{}, 1)}
+		l.locks[userID] = ul
+	}
+	ul.refs++
+	l.lk.Unlock()
+
+	select {
+	case ul.ch <- struct{}{}:
+		lctx, cancel := context.WithCancel(ctx)
+		var once sync.Once
+		return lctx, func() {
+			once.Do(func() {
+				cancel()
+				<-ul.ch
+				l.release(userID, ul)
+			})
+		}, nil
+	case <-ctx.Done():
+		l.release(userID, ul)
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (l *localUserLocker) release(userID string, ul *localLock) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+	ul.refs--
+	if ul.refs == 0 {
+		delete(l.locks, userID)
+	}
+}
+
+// Bounds of the delay between two attempts at taking a distributed lock.
+const (
+	lockRetryMin = 10 * time.Millisecond
+	lockRetryMax = 250 * time.Millisecond
+)
+
+// DefaultLockTTL is the lease of the distributed user locks. Held locks are
+// renewed in the background, the lease only matters when a gateway dies
+// while holding one.
+const DefaultLockTTL = 30 * time.Second
+
+// leaseStore is a store able to hold expiring locks identified by a token.
+type leaseStore interface {
+	// acquire takes key for ttl if nobody holds it.
+	acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// refresh extends the lease of key if it is still held with token.
+	refresh(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// release frees key if it is still held with token.
+	release(ctx context.Context, key, token string) error
+}
+
+// leaseLocker is a UserLocker shared by several gateways through a
+// leaseStore.
+//
+// A holder whose lease is taken over, or could not be renewed before it
+// expired, has its lock context canceled, so that it does not keep writing
+// alongside the next holder.
+type leaseLocker struct {
+	store leaseStore
+	ttl   time.Duration
+}
+
+func (l *leaseLocker) Lock(ctx context.Context, userID string) (context.Context, func(), error) {
+	key := lockKey(userID)
+	token, err := newRandomID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wait := lockRetryMin
+	var expiry time.Time
+	for {
+		expiry = time.Now().Add(l.ttl)
+		ok, err := l.store.acquire(ctx, key, token, l.ttl)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			break
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, nil, ctx.Err()
+		}
+		if wait *= 2; wait > lockRetryMax {
+			wait = lockRetryMax
+		}
+	}
+
+	lctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				renewed := time.Now().Add(l.ttl)
+				ok, err := l.store.refresh(context.Background(), key, token, l.ttl)
+				switch {
+				case err == nil && ok:
+					expiry = renewed
+				case err == nil:
+					logger.Errorf("lost the lock of user %s", userID)
+					cancel()
+					return
+				case !time.Now().Before(expiry):
+					logger.Errorf("lost the lock of user %s, could not renew it: %s", userID, err)
+					cancel()
+					return
+				default:
+					logger.Errorf("could not renew the lock of user %s: %s", userID, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return lctx, func() {
+		once.Do(func() {
+			cancel()
+			close(stop)
+			<-done
+			if err := l.store.release(context.Background(), key, token); err != nil {
+				logger.Errorf("could not release the lock of user %s: %s", userID, err)
+			}
+		})
+	}, nil
+}
+
+func newRandomID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
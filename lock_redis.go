@@ -0,0 +1,48 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	refreshLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+	releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+)
+
+type redisLeaseStore struct {
+	rdb redis.UniversalClient
+}
+
+// NewRedisUserLocker returns a UserLocker shared by all the gateways using
+// rdb. Locks are leased for ttl, or DefaultLockTTL if ttl is zero, and renewed
+// while held.
+func NewRedisUserLocker(rdb redis.UniversalClient, ttl time.Duration) UserLocker {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	return &leaseLocker{store: &redisLeaseStore{rdb: rdb}, ttl: ttl}
+}
+
+func (r *redisLeaseStore) acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return r.rdb.SetNX(ctx, key, token, ttl).Result()
+}
+
+func (r *redisLeaseStore) refresh(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	n, err := refreshLockScript.Run(ctx, r.rdb, []string{key}, token, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (r *redisLeaseStore) release(ctx context.Context, key, token string) error {
+	return releaseLockScript.Run(ctx, r.rdb, []string{key}, token).Err()
+}
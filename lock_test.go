@@ -0,0 +1,181 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalUserLocker(t *testing.T) {
+	ctx := context.Background()
+	l := NewLocalUserLocker().(*localUserLocker)
+
+	lctx, unlock, err := l.Lock(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other users are not blocked.
+	_, unlockBob, err := l.Lock(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockBob()
+
+	tctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := l.Lock(tctx, "alice"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+
+	got := make(chan struct{})
+	go func() {
+		_, unlock, err := l.Lock(ctx, "alice")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		unlock()
+		close(got)
+	}()
+	if lctx.Err() != nil {
+		t.Fatal("expected the lock context to be live while the lock is held")
+	}
+	unlock()
+	unlock() // Releasing twice is harmless.
+	<-got
+	if lctx.Err() == nil {
+		t.Fatal("expected the lock context to be canceled once the lock is released")
+	}
+
+	if len(l.locks) != 0 {
+		t.Fatalf("expected released locks to be forgotten, %d left", len(l.locks))
+	}
+}
+
+// memoryLeaseStore is a leaseStore for tests, ignoring expiry.
+type memoryLeaseStore struct {
+	lk        sync.Mutex
+	holders   map[string]string
+	refreshes int
+}
+
+func (m *memoryLeaseStore) acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if _, ok := m.holders[key]; ok {
+		return false, nil
+	}
+	m.holders[key] = token
+	return true, nil
+}
+
+func (m *memoryLeaseStore) refresh(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.refreshes++
+	return m.holders[key] == token, nil
+}
+
+func (m *memoryLeaseStore) release(ctx context.Context, key, token string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	if m.holders[key] == token {
+		delete(m.holders, key)
+	}
+	return nil
+}
+
+func TestLeaseLocker(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryLeaseStore{holders: make(map[string]string)}
+	// Two gateways sharing the same store.
+	a := &leaseLocker{store: store, ttl: 30 * time.Millisecond}
+	b := &leaseLocker{store: store, ttl: 30 * time.Millisecond}
+
+	_, unlock, err := a.Lock(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := b.Lock(tctx, "alice"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+	store.lk.Lock()
+	refreshes := store.refreshes
+	store.lk.Unlock()
+	if refreshes == 0 {
+		t.Fatal("expected the held lock to be renewed")
+	}
+
+	unlock()
+	_, unlock, err = b.Lock(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if len(store.holders) != 0 {
+		t.Fatalf("expected the lock to be released, got %v", store.holders)
+	}
+}
+
+// failingLeaseStore is a memoryLeaseStore whose renewals fail once failing is
+// set.
+type failingLeaseStore struct {
+	*memoryLeaseStore
+	failing chan struct{}
+}
+
+func (f *failingLeaseStore) refresh(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	select {
+	case <-f.failing:
+		return false, errors.New("unreachable")
+	default:
+		return f.memoryLeaseStore.refresh(ctx, key, token, ttl)
+	}
+}
+
+func TestLeaseLockerLost(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryLeaseStore{holders: make(map[string]string)}
+	l := &leaseLocker{store: store, ttl: 30 * time.Millisecond}
+
+	// The lease is taken over.
+	lctx, unlock, err := l.Lock(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.lk.Lock()
+	store.holders[lockKey("alice")] = "other"
+	store.lk.Unlock()
+	select {
+	case <-lctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lock context to be canceled once the lease is lost")
+	}
+	unlock()
+	if store.holders[lockKey("alice")] != "other" {
+		t.Fatalf("expected the new holder to keep the lock, got %v", store.holders)
+	}
+
+	// The lease cannot be renewed before it expires.
+	failing := &failingLeaseStore{memoryLeaseStore: &memoryLeaseStore{holders: make(map[string]string)}, failing: make(chan struct{})}
+	l = &leaseLocker{store: failing, ttl: 30 * time.Millisecond}
+	lctx, unlock, err = l.Lock(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	time.Sleep(50 * time.Millisecond)
+	if lctx.Err() != nil {
+		t.Fatal("expected the renewed lock to be held")
+	}
+	close(failing.failing)
+	select {
+	case <-lctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lock context to be canceled once the lease expired")
+	}
+}
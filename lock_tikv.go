@@ -0,0 +1,75 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-blockservice/tikv"
+)
+
+type tikvLeaseStore struct {
+	client *tikv.Client
+}
+
+// NewTiKVUserLocker returns a UserLocker shared by all the gateways using
+// client. Locks are leased for ttl, or DefaultLockTTL if ttl is zero, and
+// renewed while held. Lease expiry relies on the clocks of the gateways being
+// roughly in sync.
+func NewTiKVUserLocker(client *tikv.Client, ttl time.Duration) UserLocker {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	return &leaseLocker{store: &tikvLeaseStore{client: client}, ttl: ttl}
+}
+
+// get returns the current value of key, and the token and expiry it holds.
+func (t *tikvLeaseStore) get(ctx context.Context, key string) ([]byte, string, time.Time, error) {
+	kv, err := t.client.Get(ctx, []byte(key))
+	if tikv.IsNotFound(err) {
+		return nil, "", time.Time{}, nil
+	}
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	token, expires, ok := strings.Cut(string(kv.V), " ")
+	ns, err := strconv.ParseInt(expires, 10, 64)
+	if !ok || err != nil {
+		return nil, "", time.Time{}, fmt.Errorf("invalid lock %s: %q", key, kv.V)
+	}
+	return kv.V, token, time.Unix(0, ns), nil
+}
+
+func leaseValue(token string, ttl time.Duration) []byte {
+	return []byte(fmt.Sprintf("%s %d", token, time.Now().Add(ttl).UnixNano()))
+}
+
+func (t *tikvLeaseStore) acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	cur, _, expires, err := t.get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if cur != nil && time.Now().Before(expires) {
+		return false, nil
+	}
+	return t.client.CompareAndSwap(ctx, []byte(key), cur, leaseValue(token, ttl))
+}
+
+func (t *tikvLeaseStore) refresh(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	cur, holder, _, err := t.get(ctx, key)
+	if err != nil || holder != token {
+		return false, err
+	}
+	return t.client.CompareAndSwap(ctx, []byte(key), cur, leaseValue(token, ttl))
+}
+
+func (t *tikvLeaseStore) release(ctx context.Context, key, token string) error {
+	cur, holder, _, err := t.get(ctx, key)
+	if err != nil || holder != token {
+		return err
+	}
+	_, err = t.client.CompareAndSwap(ctx, []byte(key), cur, nil)
+	return err
+}
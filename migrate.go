@@ -0,0 +1,116 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+// MigrateIndex moves the entries written before the keys of the index were
+// namespaced: blocks, keyed by the hex string of their multihash, move under
+// blk/ and users, keyed by their ID, under user/. Entries already present
+// under their new key are kept. Other entries, which do not hold a record of
+// a pack, are skipped. Gateways still using the former keys must be stopped
+// first.
+//
+// It is safe to run several times, and returns the number of entries moved.
+func MigrateIndex(ctx context.Context, index BlockIndex) (int, error) {
+	var moved int
+	batch := make(map[string]string)
+	values := make(map[string][]byte)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		olds := make([]string, 0, len(batch))
+		news := make([]string, 0, len(batch))
+		for old, key := range batch {
+			olds = append(olds, old)
+			news = append(news, key)
+		}
+		existing, err := index.BatchGet(ctx, news)
+		if err != nil {
+			return err
+		}
+		kvs := make(map[string][]byte, len(news))
+		for i, key := range news {
+			if existing[i] == nil {
+				kvs[key] = values[olds[i]]
+			}
+		}
+		if len(kvs) != 0 {
+			if err := index.BatchPut(ctx, kvs); err != nil {
+				return err
+			}
+		}
+		for _, old := range olds {
+			if err := index.Delete(ctx, old); err != nil {
+				return err
+			}
+		}
+		moved += len(kvs)
+		batch = make(map[string]string)
+		values = make(map[string][]byte)
+		return nil
+	}
+
+	err := index.Iterate(ctx, "", func(key string, value []byte) error {
+		newKey, ok := migratedKey(key, value)
+		if !ok {
+			return nil
+		}
+		batch[key] = newKey
+		values[key] = value
+		if len(batch) < indexBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return moved, indexError(err)
+	}
+	return moved, indexError(flush())
+}
+
+// migratedKey returns the namespaced key of an entry stored under a former
+// key. Only the entries shaped like a former block or user record are
+// migrated, anything else sharing the index is left alone.
+func migratedKey(key string, value []byte) (string, bool) {
+	if strings.Contains(key, "/") {
+		return "", false
+	}
+	if h, err := mh.FromHexString(key); err == nil {
+		var f fileInfo
+		if hasFields(value, []string{"FileRecordID", "Size", "Offset"}) &&
+			json.Unmarshal(value, &f) == nil && f.FileRecordID != "" {
+			return blockKey(h), true
+		}
+	}
+	var fr fileRecord
+	if !hasFields(value, []string{"FileRecordID", "Size"}, "Blocks", "Created") ||
+		json.Unmarshal(value, &fr) != nil || fr.FileRecordID == "" {
+		return "", false
+	}
+	return userKey(key), true
+}
+
+// hasFields reports whether value is a JSON object holding all the required
+// fields, and no other than the optional ones.
+func hasFields(value []byte, required []string, optional ...string) bool {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(value, &fields) != nil || fields == nil {
+		return false
+	}
+	for _, f := range required {
+		if _, ok := fields[f]; !ok {
+			return false
+		}
+		delete(fields, f)
+	}
+	for _, f := range optional {
+		delete(fields, f)
+	}
+	return len(fields) == 0
+}
@@ -0,0 +1,145 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+)
+
+func TestMigrateIndex(t *testing.T) {
+	bserv, up, idx := newCdnBlockService(t)
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bserv.AddBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the entries back to the keys used before namespacing.
+	for _, key := range []string{blockKey(b.Cid().Hash()), userKey("alice")} {
+		v, err := idx.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := idx.Put(ctx, key[strings.Index(key, "/")+1:], v); err != nil {
+			t.Fatal(err)
+		}
+		if err := idx.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Entries of other applications sharing the index are left alone.
+	foreign := map[string]string{
+		"settings": `{"theme":"dark"}`,
+		"session":  `{"FileRecordID":"","Size":1}`,
+		"partial":  `{"FileRecordID":"pack-9"}`,
+		"extra":    `{"FileRecordID":"pack-9","Size":1,"Owner":"bob"}`,
+		"list":     `["pack-9"]`,
+	}
+	for k, v := range foreign {
+		if err := idx.Put(ctx, k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := MigrateIndex(ctx, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 2 {
+		t.Fatalf("expected 2 entries to be moved, got %d", moved)
+	}
+	for _, key := range []string{b.Cid().Hash().HexString(), "alice"} {
+		if _, err := idx.Get(ctx, key); !errors.Is(err, ErrIndexNotFound) {
+			t.Fatalf("expected %s to be removed, got %v", key, err)
+		}
+	}
+	if moved, err := MigrateIndex(ctx, idx); err != nil || moved != 0 {
+		t.Fatalf("expected nothing left to migrate, got %d, %v", moved, err)
+	}
+	for k, v := range foreign {
+		if got, err := idx.Get(ctx, k); err != nil || string(got) != v {
+			t.Fatalf("expected %s to be kept, got %s, %v", k, got, err)
+		}
+	}
+
+	fresh := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithUploaderClient(up), WithIndex(idx))
+	if _, err := fresh.GetBlock(ctx, b.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.AddBlock(ctx, bgen.Next()); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 1 || up.Appends != 1 {
+		t.Fatalf("expected alice to keep appending to her pack, got %d uploads and %d appends", up.Uploads, up.Appends)
+	}
+}
+
+func TestIterateBlocks(t *testing.T) {
+	bserv, _, idx := newCdnBlockService(t)
+	alice := context.WithValue(context.Background(), "userID", "alice")
+	bob := context.WithValue(context.Background(), "userID", "bob")
+	bgen := butil.NewBlockGenerator()
+	a, shared, b := bgen.Next(), bgen.Next(), bgen.Next()
+	if err := bserv.AddBlocks(alice, []blocks.Block{a, shared}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.AddBlocks(bob, []blocks.Block{shared, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(filter BlockFilter) map[string]BlockEntry {
+		t.Helper()
+		found := make(map[string]BlockEntry)
+		err := IterateBlocks(alice, idx, filter, func(e BlockEntry) error {
+			found[e.Multihash.HexString()] = e
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+	has := func(found map[string]BlockEntry, bs ...blocks.Block) bool {
+		if len(found) != len(bs) {
+			return false
+		}
+		for _, b := range bs {
+			if _, ok := found[b.Cid().Hash().HexString()]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	if all := list(BlockFilter{}); !has(all, a, shared, b) {
+		t.Fatalf("unexpected blocks %v", all)
+	}
+	if owned := list(BlockFilter{UserID: "bob"}); !has(owned, shared, b) {
+		t.Fatalf("unexpected blocks of bob %v", owned)
+	}
+	if packed := list(BlockFilter{FileRecordID: "pack-1"}); !has(packed, a, shared) {
+		t.Fatalf("unexpected blocks of pack-1 %v", packed)
+	}
+	if both := list(BlockFilter{UserID: "bob", FileRecordID: "pack-1"}); !has(both, shared) {
+		t.Fatalf("unexpected blocks of bob in pack-1 %v", both)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err := IterateBlocks(alice, idx, BlockFilter{}, func(BlockEntry) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Fatalf("expected the iteration to stop at the first error, got %d calls and %v", n, err)
+	}
+}
@@ -0,0 +1,360 @@
+package blockservice
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ipfs/go-blockservice/pinning"
+	"github.com/ipfs/go-blockservice/retry"
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+// Option configures a BlockService at construction time.
+type Option func(*config)
+
+// config carries the CDN endpoints and clients of a single blockService
+// instance, so that several services talking to different uploaders,
+// pinning services or Redis clusters can live in one process.
+type config struct {
+	uploader           string
+	uploaderClient     uploader.Client
+	pinningURL         string
+	pinningAPIKey      string
+	pinningClient      pinning.Client
+	retryPolicy        *retry.Policy
+	index              BlockIndex
+	isDedicatedGateway bool
+	tempDir            string
+	// invalidateOnMismatch removes index entries pointing at data that
+	// does not hash to their CID.
+	invalidateOnMismatch bool
+	// fetchTimeout bounds the CDN fetches shared by concurrent GetBlock
+	// calls, which do not stop with the context of any single caller.
+	fetchTimeout time.Duration
+	// fetchConcurrency bounds the CDN reads run in parallel by GetBlocks.
+	fetchConcurrency int
+	// coalesceGap and coalesceSpan control how GetBlocks merges the reads of
+	// neighbouring blocks of a pack.
+	coalesceGap  uint64
+	coalesceSpan uint64
+	cache        *BlockCache
+	userLocker   UserLocker
+	packPolicy   PackPolicy
+	// bufferBytes and bufferDelay bound the blocks aggregated per user
+	// before being written to the CDN, and bufferLimit the blocks buffered
+	// for all users.
+	bufferBytes uint64
+	bufferDelay time.Duration
+	bufferLimit uint64
+	journal     Journal
+	breaker     *CircuitBreaker
+	compaction  *compactionConfig
+	lookupOrder []Source
+}
+
+// WithUploader sets the base URL of the uploader serving packUpload,
+// zipAction and cacheFile.
+func WithUploader(uploaderURL string) Option {
+	return func(c *config) {
+		c.uploader = uploaderURL
+		c.uploaderClient = nil
+	}
+}
+
+// WithUploaderClient sets the client used to talk to the uploader, for
+// instance to share a tuned http.Client or to mock the uploader in tests.
+func WithUploaderClient(client uploader.Client) Option {
+	return func(c *config) {
+		c.uploaderClient = client
+		if u, ok := client.(*uploader.HTTPClient); ok {
+			c.uploader = u.URL()
+		}
+	}
+}
+
+// WithPinningService sets the base URL of the pinning service and the API key
+// used to authenticate against it.
+func WithPinningService(pinningServiceURL, apiKey string) Option {
+	return func(c *config) {
+		c.pinningURL = pinningServiceURL
+		c.pinningAPIKey = apiKey
+		c.pinningClient = nil
+	}
+}
+
+// WithPinningClient sets the client used to talk to the pinning service.
+func WithPinningClient(client pinning.Client) Option {
+	return func(c *config) {
+		c.pinningURL = ""
+		c.pinningClient = client
+	}
+}
+
+// WithRetryPolicy sets how the requests made to the uploader and the pinning
+// service set with WithUploader and WithPinningService are retried, and how
+// Close retries the writes of buffered blocks. It defaults to
+// retry.DefaultPolicy. Clients set with WithUploaderClient or
+// WithPinningClient keep their own policy.
+func WithRetryPolicy(p retry.Policy) Option {
+	return func(c *config) {
+		c.retryPolicy = &p
+	}
+}
+
+// WithDedicatedGateway enables bandwidth usage reporting for blocks served
+// from the CDN. The bandwidth is aggregated per block and reported to the
+// pinning service every few seconds, and on Close.
+func WithDedicatedGateway(isDedicatedGateway bool) Option {
+	return func(c *config) {
+		c.isDedicatedGateway = isDedicatedGateway
+	}
+}
+
+// WithTempDir spools blocks to files in dir while they are uploaded, instead
+// of streaming them from memory.
+func WithTempDir(dir string) Option {
+	return func(c *config) {
+		c.tempDir = dir
+	}
+}
+
+// WithInvalidateOnMismatch removes the index entry of a block when the CDN
+// serves data that does not match its CID, so that later reads go straight
+// to the exchange instead of fetching the bad range again.
+func WithInvalidateOnMismatch(invalidate bool) Option {
+	return func(c *config) {
+		c.invalidateOnMismatch = invalidate
+	}
+}
+
+// WithFetchTimeout sets how long a CDN fetch shared by concurrent GetBlock
+// calls may run. Each caller still gives up with its own context, the timeout
+// ends the fetch itself so that a stalled read does not linger.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.fetchTimeout = d
+	}
+}
+
+// WithFetchConcurrency sets how many CDN range reads GetBlocks runs in
+// parallel.
+func WithFetchConcurrency(n int) Option {
+	return func(c *config) {
+		c.fetchConcurrency = n
+	}
+}
+
+// WithRangeCoalescing controls how GetBlocks merges the CDN reads of blocks
+// stored in the same pack: blocks separated by at most gap bytes are fetched
+// with a single range read of at most span bytes, which is then split back
+// into blocks. A span of 1 disables coalescing.
+func WithRangeCoalescing(gap, span uint64) Option {
+	return func(c *config) {
+		c.coalesceGap = gap
+		c.coalesceSpan = span
+	}
+}
+
+// WithBlockCache keeps the blocks read from the CDN in cache, so that hot
+// blocks are served from memory. The same cache may be shared by several
+// blockservices.
+func WithBlockCache(cache *BlockCache) Option {
+	return func(c *config) {
+		c.cache = cache
+	}
+}
+
+// WithUserLocker sets how the pack appends of a user are serialized. The
+// default only covers a single process, gateways sharing an index should use
+// a NewRedisUserLocker or NewTiKVUserLocker.
+func WithUserLocker(l UserLocker) Option {
+	return func(c *config) {
+		c.userLocker = l
+	}
+}
+
+// WithPackPolicy sets when the blocks of a user go to a new pack instead of
+// being appended to their current one. By default packs are closed once they
+// exceed DefaultMaxPackSize.
+func WithPackPolicy(p PackPolicy) Option {
+	return func(c *config) {
+		c.packPolicy = p
+	}
+}
+
+// WithWriteBuffer aggregates the blocks added by each user in memory and
+// writes them to the CDN in a single upload or append once they total
+// maxBytes, or maxDelay after the first of them was added. Buffered blocks are
+// served from memory, and written when the blockservice is closed.
+//
+// Adds return before the blocks are written and a failure to write them is not
+// reported: the blocks are kept and written again later. Once the buffer holds
+// the limit set with WithWriteBufferLimit, adds write their blocks directly
+// and report failures.
+func WithWriteBuffer(maxBytes uint64, maxDelay time.Duration) Option {
+	return func(c *config) {
+		c.bufferBytes = maxBytes
+		c.bufferDelay = maxDelay
+	}
+}
+
+// defaultBufferLimitFactor sets the default limit of the write buffer, in
+// per user buffers.
+const defaultBufferLimitFactor = 16
+
+// WithWriteBufferLimit bounds the bytes held by the write buffer for all the
+// users. It defaults to 16 times the per user size set with WithWriteBuffer.
+func WithWriteBufferLimit(maxBytes uint64) Option {
+	return func(c *config) {
+		c.bufferLimit = maxBytes
+	}
+}
+
+// WithJournal records the pack writes in j, from before their upload until the
+// index and the pinning service reflect them. The journal is replayed in the
+// background, when the blockservice is created and every minute, to complete
+// the writes a crash left unfinished.
+func WithJournal(j Journal) Option {
+	return func(c *config) {
+		c.journal = j
+	}
+}
+
+// WithCircuitBreaker reads blocks from the blockstore and the exchange rather
+// than the CDN while b is open. The same breaker should be shared by the
+// blockservices using the same uploader.
+func WithCircuitBreaker(b *CircuitBreaker) Option {
+	return func(c *config) {
+		c.breaker = b
+	}
+}
+
+// compactionConfig is how the compaction worker runs.
+type compactionConfig struct {
+	interval time.Duration
+	opts     CompactionOptions
+}
+
+// WithCompaction compacts the packs every interval in the background, as
+// Compact does, until the blockservice is closed. Old packs are only deleted
+// if the uploader client is built with uploader.WithDeletePath.
+func WithCompaction(interval time.Duration, opts CompactionOptions) Option {
+	return func(c *config) {
+		if interval <= 0 {
+			c.compaction = nil
+			return
+		}
+		c.compaction = &compactionConfig{interval: interval, opts: opts}
+	}
+}
+
+// Source is a place GetBlock and GetBlocks look blocks up in.
+type Source int
+
+const (
+	// SourceMemory holds the blocks of the write buffer and the block cache.
+	SourceMemory Source = iota
+	// SourceBlockstore is the local blockstore.
+	SourceBlockstore
+	// SourceCdn is the uploader CDN, through the index.
+	SourceCdn
+	// SourceExchange is the network. It is only tried when an exchange is
+	// set, and always ends the lookup.
+	SourceExchange
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceMemory:
+		return "memory"
+	case SourceBlockstore:
+		return "blockstore"
+	case SourceCdn:
+		return "cdn"
+	case SourceExchange:
+		return "exchange"
+	default:
+		return "unknown"
+	}
+}
+
+// DefaultLookupOrder is the order in which blocks are looked up unless
+// configured with WithLookupOrder.
+var DefaultLookupOrder = []Source{SourceMemory, SourceBlockstore, SourceCdn, SourceExchange}
+
+// WithLookupOrder sets the sources blocks are looked up in, in order. Sources
+// that are left out are never read from, and blocks found in none of them are
+// reported as ipld.ErrNotFound.
+func WithLookupOrder(sources ...Source) Option {
+	return func(c *config) {
+		c.lookupOrder = append([]Source(nil), sources...)
+	}
+}
+
+// WithRedis keeps the CID index in the given Redis client. Any topology
+// works, see NewRedisClient for building one from RedisOptions. The client is
+// pinged when the blockservice is built, and an unreachable Redis is logged
+// as an error, as options cannot fail: callers wanting the error must build
+// the client with NewRedisClient.
+func WithRedis(rdb redis.UniversalClient) Option {
+	return func(c *config) {
+		c.index = NewRedisIndex(rdb)
+		if err := pingRedis(rdb); err != nil {
+			logger.Errorf("%s, the CID index is unreachable", err)
+		}
+	}
+}
+
+// WithIndex sets the BlockIndex holding the CID index.
+func WithIndex(index BlockIndex) Option {
+	return func(c *config) {
+		c.index = index
+	}
+}
+
+func newConfig(opts []Option) config {
+	var c config
+	for _, o := range opts {
+		o(&c)
+	}
+	policy := c.policy()
+	if c.uploaderClient == nil && c.uploader != "" {
+		c.uploaderClient = uploader.New(c.uploader, uploader.WithRetry(policy))
+	}
+	if c.pinningClient == nil && c.pinningURL != "" {
+		c.pinningClient = pinning.New(c.pinningURL, c.pinningAPIKey, pinning.WithRetry(policy))
+	}
+	if c.lookupOrder == nil {
+		c.lookupOrder = DefaultLookupOrder
+	}
+	if c.userLocker == nil {
+		c.userLocker = NewLocalUserLocker()
+	}
+	if c.packPolicy == nil {
+		c.packPolicy = defaultPackPolicy
+	}
+	if c.fetchTimeout <= 0 {
+		c.fetchTimeout = defaultFetchTimeout
+	}
+	if c.bufferLimit == 0 {
+		c.bufferLimit = defaultBufferLimitFactor * c.bufferBytes
+	}
+	return c
+}
+
+// policy returns the retry policy set with WithRetryPolicy, or
+// retry.DefaultPolicy.
+func (c *config) policy() retry.Policy {
+	if c.retryPolicy != nil {
+		return *c.retryPolicy
+	}
+	return retry.DefaultPolicy
+}
+
+// cdnEnabled reports whether blocks are stored in and served from the
+// uploader CDN. Without an uploader and an index, the blockservice works
+// purely on top of the local blockstore and the exchange.
+func (c *config) cdnEnabled() bool {
+	return c.uploaderClient != nil && c.index != nil
+}
@@ -0,0 +1,170 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// blockOwners is the index entry listing the users referencing a block.
+// Blocks are stored once, in the pack of the first user adding them, and
+// accounted to every user referencing them. Blocks stored without a user are
+// owned by the empty string, which never claims blocks stored by others.
+type blockOwners struct {
+	Users []string
+}
+
+// add adds userID to the owners and reports whether it was not one already.
+func (o *blockOwners) add(userID string) bool {
+	i := sort.SearchStrings(o.Users, userID)
+	if i < len(o.Users) && o.Users[i] == userID {
+		return false
+	}
+	o.Users = append(o.Users, "")
+	copy(o.Users[i+1:], o.Users[i:])
+	o.Users[i] = userID
+	return true
+}
+
+// remove removes userID from the owners and reports whether it was one.
+func (o *blockOwners) remove(userID string) bool {
+	i := sort.SearchStrings(o.Users, userID)
+	if i == len(o.Users) || o.Users[i] != userID {
+		return false
+	}
+	o.Users = append(o.Users[:i], o.Users[i+1:]...)
+	return true
+}
+
+// parseOwners decodes the owners of a block of the pack described by pr.
+// Blocks indexed before their owners were recorded are owned by the owner of
+// their pack.
+func parseOwners(v []byte, pr packRecord) (blockOwners, error) {
+	var o blockOwners
+	if v == nil {
+		o.Users = []string{pr.UserID}
+		return o, nil
+	}
+	if err := json.Unmarshal(v, &o); err != nil {
+		return o, fmt.Errorf("failed to unmarshal `blockOwners`: %w", err)
+	}
+	return o, nil
+}
+
+func (s *blockService) getOwners(ctx context.Context, key string, pr packRecord) (blockOwners, error) {
+	v, err := s.index.Get(ctx, ownersKey(key))
+	if errors.Is(err, ErrIndexNotFound) {
+		v, err = nil, nil
+	}
+	if err != nil {
+		return blockOwners{}, indexError(err)
+	}
+	return parseOwners(v, pr)
+}
+
+// claimBlocks records userID as an owner of the already indexed blocks of
+// infos, which maps their index keys to their index entries, and accounts
+// them to userID, unless it is empty. It returns the keys of the blocks that were deleted in the
+// meantime and must be stored again.
+func (s *blockService) claimBlocks(ctx context.Context, userID string, infos map[string]fileInfo) ([]string, error) {
+	var gone []string
+	for len(infos) != 0 {
+		byPack := make(map[string][]string)
+		for key, f := range infos {
+			byPack[f.FileRecordID] = append(byPack[f.FileRecordID], key)
+		}
+		moved := make(map[string]fileInfo)
+		for id, keys := range byPack {
+			g, err := s.claimPackBlocks(ctx, userID, id, keys, moved)
+			if err != nil {
+				return nil, err
+			}
+			gone = append(gone, g...)
+		}
+		// Blocks moved by a compaction are claimed in their new pack.
+		infos = moved
+	}
+	return gone, nil
+}
+
+// claimPackBlocks claims the blocks of keys that are still in the pack
+// fileRecordID. Those that were moved to another pack are added to moved.
+func (s *blockService) claimPackBlocks(ctx context.Context, userID, fileRecordID string, keys []string, moved map[string]fileInfo) ([]string, error) {
+	ctx, unlock, err := s.lockPack(ctx, fileRecordID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	okeys := make([]string, len(keys))
+	for i, key := range keys {
+		okeys[i] = ownersKey(key)
+	}
+	cur, err := s.index.BatchGet(ctx, append(keys[:len(keys):len(keys)], okeys...))
+	if err != nil {
+		return nil, indexError(err)
+	}
+	pr, err := s.getPackRecord(ctx, fileRecordID)
+	if err != nil && !errors.Is(err, ErrIndexNotFound) {
+		return nil, err
+	}
+	g, err := s.getPackGarbage(ctx, fileRecordID)
+	if err != nil {
+		return nil, err
+	}
+
+	var gone []string
+	kvs := make(map[string][]byte)
+	for i, key := range keys {
+		if cur[i] == nil {
+			gone = append(gone, key)
+			continue
+		}
+		var f fileInfo
+		if err := json.Unmarshal(cur[i], &f); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal `fileInfo`: %w", err)
+		}
+		if f.FileRecordID != fileRecordID {
+			moved[key] = f
+			continue
+		}
+		if userID == "" {
+			// Nobody to account the block to, it is already stored.
+			continue
+		}
+		owners, err := parseOwners(cur[len(keys)+i], pr)
+		if err != nil {
+			return nil, err
+		}
+		if !owners.add(userID) {
+			continue
+		}
+		g.ref(pr.UserID, userID, f.Size)
+		ob, err := json.Marshal(owners)
+		if err != nil {
+			return nil, err
+		}
+		kvs[okeys[i]] = ob
+	}
+	if len(kvs) == 0 {
+		return gone, nil
+	}
+
+	gb, err := json.Marshal(g)
+	if err != nil {
+		return nil, err
+	}
+	kvs[garbageKey(fileRecordID)] = gb
+	if err := s.index.BatchPut(ctx, kvs); err != nil {
+		return nil, indexError(err)
+	}
+	if userID != "" && s.pinningClient != nil {
+		err := s.pinningClient.CreateFileRecord(ctx, userID, fileRecordID, g.accounted(userID, pr))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file record: %w", err)
+		}
+	}
+	return gone, nil
+}
@@ -0,0 +1,258 @@
+package blockservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestSharedBlockOwnership(t *testing.T) {
+	pin := newRecordingPinning()
+	bserv, up, idx := newCdnBlockService(t, WithPinningClient(pin))
+	alice := context.WithValue(context.Background(), "userID", "alice")
+	bob := context.WithValue(context.Background(), "userID", "bob")
+	bgen := butil.NewBlockGenerator()
+	shared, own := bgen.Next(), bgen.Next()
+	size := uint64(len(shared.RawData()))
+	total := size + uint64(len(own.RawData()))
+
+	if err := bserv.AddBlocks(alice, []blocks.Block{shared, own}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.AddBlock(bob, shared); err != nil {
+		t.Fatal(err)
+	}
+	if up.Uploads != 1 || up.Appends != 0 {
+		t.Fatalf("expected the shared block to be stored once, got %d uploads and %d appends", up.Uploads, up.Appends)
+	}
+	if pin.records["alice/pack-1"] != total || pin.records["bob/pack-1"] != size {
+		t.Fatalf("expected both users to be accounted for the shared block, got %v", pin.records)
+	}
+	// Adding it again does not account it twice.
+	if err := bserv.AddBlock(bob, shared); err != nil {
+		t.Fatal(err)
+	}
+	if pin.records["bob/pack-1"] != size {
+		t.Fatalf("expected bob to be accounted once, got %v", pin.records)
+	}
+
+	// The delete of a user who does not reference the block does nothing.
+	carol := context.WithValue(context.Background(), "userID", "carol")
+	if err := bserv.DeleteBlock(carol, shared.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.DeleteBlock(alice, shared.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	fresh := New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithUploaderClient(up), WithIndex(idx))
+	if _, err := fresh.GetBlock(bob, shared.Cid()); err != nil {
+		t.Fatalf("expected bob to keep the block deleted by alice, got %v", err)
+	}
+	if pin.records["alice/pack-1"] != total-size || pin.records["bob/pack-1"] != size {
+		t.Fatalf("expected alice to stop being accounted for the block, got %v", pin.records)
+	}
+
+	if err := bserv.DeleteBlock(bob, shared.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.Get(bob, blockKey(shared.Cid().Hash())); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("expected the block to be removed with its last owner, got %v", err)
+	}
+	g, err := bserv.(*blockService).getPackGarbage(bob, "pack-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Bytes != size || g.Released != 0 || len(g.Shared) != 0 {
+		t.Fatalf("unexpected pack accounting %+v", g)
+	}
+	if pin.records["alice/pack-1"] != total-size || pin.records["bob/pack-1"] != 0 {
+		t.Fatalf("unexpected file records %v", pin.records)
+	}
+}
+
+func TestOwnerlessDelete(t *testing.T) {
+	pin := newRecordingPinning()
+	bserv, _, idx := newCdnBlockService(t, WithPinningClient(pin))
+	alice := context.WithValue(context.Background(), "userID", "alice")
+	bob := context.WithValue(context.Background(), "userID", "bob")
+	anon := context.Background()
+	bgen := butil.NewBlockGenerator()
+	shared, own := bgen.Next(), bgen.Next()
+	size := uint64(len(shared.RawData()))
+
+	if err := bserv.AddBlocks(alice, []blocks.Block{shared, own}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.AddBlock(bob, shared); err != nil {
+		t.Fatal(err)
+	}
+	// An anonymous add does not claim a stored block.
+	if err := bserv.AddBlock(anon, shared); err != nil {
+		t.Fatal(err)
+	}
+	owners, err := bserv.(*blockService).getOwners(anon, blockKey(shared.Cid().Hash()), packRecord{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners.Users) != 2 || owners.Users[0] != "alice" || owners.Users[1] != "bob" {
+		t.Fatalf("unexpected owners %v", owners.Users)
+	}
+
+	// A delete without a user drops the block for all its owners.
+	if err := bserv.DeleteBlock(anon, shared.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{blockKey(shared.Cid().Hash()), ownersKey(blockKey(shared.Cid().Hash()))} {
+		if _, err := idx.Get(anon, k); !errors.Is(err, ErrIndexNotFound) {
+			t.Fatalf("expected %s to be removed, got %v", k, err)
+		}
+	}
+	g, err := bserv.(*blockService).getPackGarbage(anon, "pack-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Bytes != size || g.Released != 0 || len(g.Shared) != 0 {
+		t.Fatalf("unexpected pack accounting %+v", g)
+	}
+	if pin.records["alice/pack-1"] != uint64(len(own.RawData())) || pin.records["bob/pack-1"] != 0 {
+		t.Fatalf("unexpected file records %v", pin.records)
+	}
+}
+
+func TestLegacyDelete(t *testing.T) {
+	pin := newRecordingPinning()
+	bserv, up, idx := newCdnBlockService(t, WithPinningClient(pin))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	bs := bgen.Blocks(3)
+	if err := bserv.AddBlocks(ctx, bs); err != nil {
+		t.Fatal(err)
+	}
+	fr, err := bserv.(*blockService).getFileRecord(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Index the blocks and the user the way they were before packs and
+	// owners were recorded, and migrate them.
+	for _, k := range []string{packKey("pack-1"), garbageKey("pack-1")} {
+		if err := idx.Delete(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, b := range bs {
+		key := blockKey(b.Cid().Hash())
+		v, err := idx.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{key, ownersKey(key)} {
+			if err := idx.Delete(ctx, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := idx.Put(ctx, key[strings.Index(key, "/")+1:], v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy, err := json.Marshal(struct {
+		FileRecordID string
+		Size         uint64
+	}{fr.FileRecordID, fr.Size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Delete(ctx, userKey("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Put(ctx, "alice", legacy); err != nil {
+		t.Fatal(err)
+	}
+	if moved, err := MigrateIndex(ctx, idx); err != nil || moved != len(bs)+1 {
+		t.Fatalf("expected %d entries to be moved, got %d, %v", len(bs)+1, moved, err)
+	}
+
+	fresh := func() BlockService {
+		return New(blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())), nil, WithUploaderClient(up), WithIndex(idx))
+	}
+	// The pack is still the current one of alice, who is told about its
+	// remaining bytes.
+	if err := bserv.DeleteBlock(ctx, bs[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fresh().GetBlock(ctx, bs[0].Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected the block to be deleted, got %v", err)
+	}
+	want := fr.Size - uint64(len(bs[0].RawData()))
+	if got := pin.records["alice/pack-1"]; got != want {
+		t.Fatalf("expected alice to be accounted for %d bytes, got %d", want, got)
+	}
+
+	// Once alice moved on to another pack, the size of this one is unknown.
+	if err := idx.Put(ctx, userKey("alice"), []byte(`{"FileRecordID":"pack-9","Size":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.DeleteBlock(ctx, bs[1].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fresh().GetBlock(ctx, bs[1].Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected the block to be deleted, got %v", err)
+	}
+	if got := pin.records["alice/pack-1"]; got != want {
+		t.Fatalf("expected the file record to be left alone, got %d bytes", got)
+	}
+	if _, err := fresh().GetBlock(ctx, bs[2].Cid()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactSharedBlocks(t *testing.T) {
+	pin := newRecordingPinning()
+	bserv, up, _ := newCdnBlockService(t, WithPinningClient(pin))
+	alice := context.WithValue(context.Background(), "userID", "alice")
+	bob := context.WithValue(context.Background(), "userID", "bob")
+	bgen := butil.NewBlockGenerator()
+	bs := bgen.Blocks(4)
+	if err := bserv.AddBlocks(alice, bs); err != nil {
+		t.Fatal(err)
+	}
+	if err := bserv.AddBlock(bob, bs[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range bs {
+		if err := bserv.DeleteBlock(alice, b.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Compact(alice, bserv, CompactionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Packs) != 1 || report.Packs[0].LiveBlocks != 1 || up.Has("pack-1") {
+		t.Fatalf("expected the block of bob to be moved, got %+v", report)
+	}
+	size := uint64(len(bs[0].RawData()))
+	if pin.records["bob/pack-1"] != 0 || pin.records["bob/pack-2"] != size {
+		t.Fatalf("expected bob to be accounted in the new pack, got %v", pin.records)
+	}
+	if pin.records["alice/pack-1"] != 0 || pin.records["alice/pack-2"] != 0 {
+		t.Fatalf("expected alice not to be accounted, got %v", pin.records)
+	}
+
+	if err := bserv.DeleteBlock(bob, bs[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if pin.records["bob/pack-2"] != 0 {
+		t.Fatalf("expected bob to release the moved block, got %v", pin.records)
+	}
+}
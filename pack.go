@@ -0,0 +1,109 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultMaxPackSize is the size past which the default PackPolicy stops
+// appending to a pack.
+const DefaultMaxPackSize = 100 << 20
+
+// PackInfo describes the pack a user currently appends to.
+type PackInfo struct {
+	FileRecordID string
+	// Size is the number of bytes stored in the pack.
+	Size uint64
+	// Blocks is the number of blocks stored in the pack.
+	Blocks int
+	// Created is when the pack was uploaded. It is zero for packs written
+	// before it was recorded.
+	Created time.Time
+}
+
+// PackPolicy decides when the blocks of a user go to a new pack instead of
+// being appended to their current one.
+type PackPolicy interface {
+	// Rollover reports whether blocks totalling size bytes, added by userID,
+	// should be uploaded to a new pack rather than appended to cur.
+	Rollover(ctx context.Context, userID string, cur PackInfo, blocks int, size uint64) bool
+}
+
+// LimitPolicy is a PackPolicy rolling over to a new pack when the current one
+// has reached any of its limits. Zero limits are ignored.
+//
+// Unless BeforeAppend is set, packs may exceed MaxBytes or MaxBlocks by the
+// blocks of a single add.
+type LimitPolicy struct {
+	// MaxBytes bounds the size of a pack.
+	MaxBytes uint64
+	// MaxBlocks bounds the number of blocks of a pack.
+	MaxBlocks int
+	// MaxAge bounds the time during which a pack is appended to.
+	MaxAge time.Duration
+	// BeforeAppend checks the limits against the pack as it would be after
+	// the append, so that an add does not take it past them. The size of the
+	// added blocks does not include their zip headers, which may still take
+	// the pack slightly over MaxBytes. Otherwise a pack is only closed once
+	// it has reached its limits.
+	BeforeAppend bool
+}
+
+var _ PackPolicy = LimitPolicy{}
+
+func (p LimitPolicy) Rollover(ctx context.Context, userID string, cur PackInfo, blocks int, size uint64) bool {
+	reached := func(n, max uint64) bool {
+		return n >= max
+	}
+	if p.BeforeAppend {
+		cur.Size += size
+		cur.Blocks += blocks
+		reached = func(n, max uint64) bool {
+			return n > max
+		}
+	}
+	switch {
+	case p.MaxBytes != 0 && reached(cur.Size, p.MaxBytes):
+		return true
+	case p.MaxBlocks != 0 && reached(uint64(cur.Blocks), uint64(p.MaxBlocks)):
+		return true
+	case p.MaxAge != 0 && !cur.Created.IsZero() && time.Since(cur.Created) >= p.MaxAge:
+		return true
+	}
+	return false
+}
+
+// TieredPolicy applies a different PackPolicy to each tier of users.
+type TieredPolicy struct {
+	// Tier returns the tier of userID.
+	Tier func(ctx context.Context, userID string) string
+	// Tiers maps tiers to their policy.
+	Tiers map[string]PackPolicy
+	// Default applies to users whose tier has no policy.
+	Default PackPolicy
+}
+
+var _ PackPolicy = (*TieredPolicy)(nil)
+
+func (p *TieredPolicy) Rollover(ctx context.Context, userID string, cur PackInfo, blocks int, size uint64) bool {
+	policy := p.Default
+	if tp, ok := p.Tiers[p.Tier(ctx, userID)]; ok {
+		policy = tp
+	}
+	if policy == nil {
+		policy = defaultPackPolicy
+	}
+	return policy.Rollover(ctx, userID, cur, blocks, size)
+}
+
+// defaultPackPolicy closes packs once they are over DefaultMaxPackSize, as
+// before packs had a policy.
+var defaultPackPolicy PackPolicy = sizePolicy(DefaultMaxPackSize)
+
+// sizePolicy is a PackPolicy rolling over to a new pack once the current one
+// is larger than its size.
+type sizePolicy uint64
+
+func (p sizePolicy) Rollover(ctx context.Context, userID string, cur PackInfo, blocks int, size uint64) bool {
+	return cur.Size > uint64(p)
+}
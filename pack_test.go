@@ -0,0 +1,94 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+)
+
+func TestLimitPolicy(t *testing.T) {
+	ctx := context.Background()
+	old := time.Now().Add(-time.Hour)
+	cases := []struct {
+		name   string
+		policy LimitPolicy
+		cur    PackInfo
+		blocks int
+		size   uint64
+		want   bool
+	}{
+		{"no limits", LimitPolicy{}, PackInfo{Size: 1 << 40, Blocks: 1 << 20, Created: old}, 1, 1, false},
+		{"under max bytes", LimitPolicy{MaxBytes: 100}, PackInfo{Size: 99}, 1, 10, false},
+		{"reached max bytes", LimitPolicy{MaxBytes: 100}, PackInfo{Size: 100}, 1, 10, true},
+		{"would exceed max bytes", LimitPolicy{MaxBytes: 100, BeforeAppend: true}, PackInfo{Size: 95}, 1, 10, true},
+		{"would fill max bytes", LimitPolicy{MaxBytes: 100, BeforeAppend: true}, PackInfo{Size: 90}, 1, 10, false},
+		{"reached max blocks", LimitPolicy{MaxBlocks: 3}, PackInfo{Blocks: 3}, 1, 1, true},
+		{"would exceed max blocks", LimitPolicy{MaxBlocks: 3, BeforeAppend: true}, PackInfo{Blocks: 2}, 2, 1, true},
+		{"too old", LimitPolicy{MaxAge: time.Minute}, PackInfo{Created: old}, 1, 1, true},
+		{"young enough", LimitPolicy{MaxAge: 2 * time.Hour}, PackInfo{Created: old}, 1, 1, false},
+		{"unknown age", LimitPolicy{MaxAge: time.Minute}, PackInfo{}, 1, 1, false},
+	}
+	for _, tc := range cases {
+		if got := tc.policy.Rollover(ctx, "alice", tc.cur, tc.blocks, tc.size); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestDefaultPackPolicy(t *testing.T) {
+	ctx := context.Background()
+	if defaultPackPolicy.Rollover(ctx, "alice", PackInfo{Size: DefaultMaxPackSize}, 1, 1) {
+		t.Fatal("expected a full pack to be appended to")
+	}
+	if !defaultPackPolicy.Rollover(ctx, "alice", PackInfo{Size: DefaultMaxPackSize + 1}, 1, 1) {
+		t.Fatal("expected a pack over the default size to be closed")
+	}
+}
+
+func TestTieredPolicy(t *testing.T) {
+	ctx := context.Background()
+	p := &TieredPolicy{
+		Tier: func(ctx context.Context, userID string) string {
+			if userID == "alice" {
+				return "premium"
+			}
+			return "free"
+		},
+		Tiers: map[string]PackPolicy{
+			"premium": LimitPolicy{MaxBytes: 1000},
+		},
+		Default: LimitPolicy{MaxBytes: 10},
+	}
+	cur := PackInfo{Size: 100}
+	if p.Rollover(ctx, "alice", cur, 1, 1) {
+		t.Fatal("premium users should keep appending")
+	}
+	if !p.Rollover(ctx, "bob", cur, 1, 1) {
+		t.Fatal("free users should roll over")
+	}
+}
+
+func TestPackPolicyRollover(t *testing.T) {
+	bserv, up, _ := newCdnBlockService(t, WithPackPolicy(LimitPolicy{MaxBlocks: 2}))
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+
+	for i := 0; i < 5; i++ {
+		if err := bserv.AddBlock(ctx, bgen.Next()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Packs of 2, 2 and 1 blocks.
+	if up.Uploads != 3 || up.Appends != 2 {
+		t.Fatalf("expected 3 uploads and 2 appends, got %d and %d", up.Uploads, up.Appends)
+	}
+	fr, err := bserv.(*blockService).getFileRecord(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.FileRecordID != "pack-3" || fr.Blocks != 1 || fr.Created.IsZero() {
+		t.Fatalf("unexpected file record %+v", fr)
+	}
+}
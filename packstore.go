@@ -0,0 +1,149 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-verifcid"
+
+	"github.com/ipfs/go-blockservice/internal"
+)
+
+// ErrCdnDisabled is returned by NewPackBlockstore when no uploader or no
+// index is configured.
+var ErrCdnDisabled = errors.New("blockservice: no uploader or index configured")
+
+// PackBlockstore is a blockstore.Blockstore keeping blocks in the uploader
+// packs, for components expecting a blockstore rather than a BlockService.
+// Blocks are written, read, accounted and deleted as a CDN backed
+// BlockService does, on behalf of the user of the context.
+type PackBlockstore struct {
+	s *blockService
+}
+
+var _ blockstore.Blockstore = (*PackBlockstore)(nil)
+
+// NewPackBlockstore returns a PackBlockstore configured with opts, which must
+// set an uploader and an index. Blocks are looked up in memory, then in the
+// CDN, whatever the lookup order.
+func NewPackBlockstore(opts ...Option) (*PackBlockstore, error) {
+	opts = append(opts[:len(opts):len(opts)], WithLookupOrder(SourceMemory, SourceCdn))
+	s := newBlockService(nil, nil, false, opts)
+	if !s.cdnEnabled() {
+		return nil, ErrCdnDisabled
+	}
+	return &PackBlockstore{s: s}, nil
+}
+
+func (p *PackBlockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	if _, ok := p.s.buffer.get(c); ok {
+		return true, nil
+	}
+	_, err := p.s.index.Get(ctx, blockKey(c.Hash()))
+	if errors.Is(err, ErrIndexNotFound) {
+		return false, nil
+	}
+	return err == nil, indexError(err)
+}
+
+func (p *PackBlockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ctx, span := internal.StartSpan(ctx, "PackBlockstore.Get")
+	defer span.End()
+
+	return p.s.getBlock(ctx, c, nil, nil)
+}
+
+// GetSize returns the size of c as recorded in the index, without reading it.
+func (p *PackBlockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	if blk, ok := p.s.buffer.get(c); ok {
+		return len(blk.RawData()), nil
+	}
+	f, err := p.s.getFileInfo(ctx, c.Hash())
+	if errors.Is(err, ErrIndexNotFound) {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	if err != nil {
+		return -1, indexError(err)
+	}
+	return int(f.Size), nil
+}
+
+func (p *PackBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	return p.PutMany(ctx, []blocks.Block{b})
+}
+
+func (p *PackBlockstore) PutMany(ctx context.Context, bs []blocks.Block) error {
+	ctx, span := internal.StartSpan(ctx, "PackBlockstore.PutMany")
+	defer span.End()
+
+	for _, b := range bs {
+		if err := verifcid.ValidateCid(b.Cid()); err != nil {
+			return err
+		}
+	}
+	_, err := p.s.addBlocksCdn(ctx, bs)
+	return err
+}
+
+func (p *PackBlockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	ctx, span := internal.StartSpan(ctx, "PackBlockstore.DeleteBlock")
+	defer span.End()
+
+	if p.s.cache != nil {
+		p.s.cache.Remove(c)
+	}
+	p.s.buffer.remove(c)
+	return p.s.deleteBlockCdn(ctx, c)
+}
+
+// AllKeysChan returns the buffered and indexed blocks, as CIDv1 of raw
+// blocks since the index only knows their multihashes.
+func (p *PackBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	out := make(chan cid.Cid)
+	go func() {
+		defer close(out)
+		send := func(c cid.Cid) error {
+			select {
+			case out <- c:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		seen := make(map[string]struct{})
+		for _, c := range p.s.buffer.cids() {
+			key := blockKey(c.Hash())
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if send(cid.NewCidV1(cid.Raw, c.Hash())) != nil {
+				return
+			}
+		}
+		err := IterateBlocks(ctx, p.s.index, BlockFilter{}, func(e BlockEntry) error {
+			if _, ok := seen[blockKey(e.Multihash)]; ok {
+				return nil
+			}
+			return send(cid.NewCidV1(cid.Raw, e.Multihash))
+		})
+		if err != nil && ctx.Err() == nil {
+			logger.Errorf("AllKeysChan: %s", err)
+		}
+	}()
+	return out, nil
+}
+
+// HashOnRead has no effect: blocks read from the CDN are always checked
+// against their CID.
+func (p *PackBlockstore) HashOnRead(enabled bool) {}
+
+// Close writes the buffered blocks and stops the background work.
+func (p *PackBlockstore) Close() error {
+	return p.s.Close()
+}
@@ -0,0 +1,135 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	butil "github.com/ipfs/go-ipfs-blocksutil"
+	ipld "github.com/ipfs/go-ipld-format"
+
+	"github.com/ipfs/go-blockservice/uploader"
+)
+
+func TestPackBlockstore(t *testing.T) {
+	up := uploader.NewMock()
+	bs, err := NewPackBlockstore(WithUploaderClient(up), WithIndex(NewMemoryIndex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ctx := context.WithValue(context.Background(), "userID", "alice")
+	bgen := butil.NewBlockGenerator()
+	a, b := bgen.Next(), bgen.Next()
+
+	if err := bs.PutMany(ctx, []blocks.Block{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := bs.Has(ctx, a.Cid()); err != nil || !has {
+		t.Fatalf("expected the block to be stored, got %t, %v", has, err)
+	}
+	reads := up.Reads
+	if size, err := bs.GetSize(ctx, a.Cid()); err != nil || size != len(a.RawData()) {
+		t.Fatalf("expected a size of %d, got %d, %v", len(a.RawData()), size, err)
+	}
+	if up.Reads != reads {
+		t.Fatal("GetSize should not read the CDN")
+	}
+	got, err := bs.Get(ctx, a.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Cid().Equals(a.Cid()) {
+		t.Fatalf("got block %s, expected %s", got.Cid(), a.Cid())
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for c := range keys {
+		found[c.Hash().HexString()] = true
+	}
+	if len(found) != 2 || !found[a.Cid().Hash().HexString()] || !found[b.Cid().Hash().HexString()] {
+		t.Fatalf("unexpected keys %v", found)
+	}
+
+	if err := bs.DeleteBlock(ctx, a.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(ctx, a.Cid()); has {
+		t.Fatal("expected the block to be deleted")
+	}
+	if _, err := bs.Get(ctx, a.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected ipld.ErrNotFound, got %v", err)
+	}
+	if _, err := bs.GetSize(ctx, a.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected ipld.ErrNotFound, got %v", err)
+	}
+}
+
+func TestPackBlockstoreDeleteWithoutUser(t *testing.T) {
+	bs, err := NewPackBlockstore(WithUploaderClient(uploader.NewMock()), WithIndex(NewMemoryIndex()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+
+	if err := bs.Put(context.WithValue(context.Background(), "userID", "alice"), b); err != nil {
+		t.Fatal(err)
+	}
+	// The GC deletes blocks without a user.
+	ctx := context.Background()
+	if err := bs.DeleteBlock(ctx, b.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := bs.Has(ctx, b.Cid()); err != nil || has {
+		t.Fatalf("expected the block to be deleted, got %t, %v", has, err)
+	}
+}
+
+func TestPackBlockstoreBuffered(t *testing.T) {
+	bs, err := NewPackBlockstore(WithUploaderClient(uploader.NewMock()), WithIndex(NewMemoryIndex()), WithWriteBuffer(1<<20, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	ctx := context.Background()
+	bgen := butil.NewBlockGenerator()
+	b := bgen.Next()
+	if err := bs.Put(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bs.Has(ctx, b.Cid()); !has {
+		t.Fatal("expected buffered blocks to be found")
+	}
+	if size, _ := bs.GetSize(ctx, b.Cid()); size != len(b.RawData()) {
+		t.Fatalf("expected a size of %d, got %d", len(b.RawData()), size)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	keys, err := bs.AllKeysChan(cctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []cid.Cid
+	for c := range keys {
+		all = append(all, c)
+	}
+	if len(all) != 1 || !all[0].Equals(cid.NewCidV1(cid.Raw, b.Cid().Hash())) {
+		t.Fatalf("unexpected keys %v", all)
+	}
+}
+
+func TestPackBlockstoreNeedsCdn(t *testing.T) {
+	if _, err := NewPackBlockstore(); !errors.Is(err, ErrCdnDisabled) {
+		t.Fatalf("expected ErrCdnDisabled, got %v", err)
+	}
+}
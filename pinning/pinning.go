@@ -0,0 +1,157 @@
+// Package pinning implements a client for the pinning service keeping track
+// of the file records owned by users and of the bandwidth they consume.
+package pinning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/go-blockservice/retry"
+)
+
+// Client is the set of pinning service operations used by the blockservice.
+type Client interface {
+	// CreateFileRecord records that userID owns size bytes in the pack
+	// fileRecordID.
+	CreateFileRecord(ctx context.Context, userID, fileRecordID string, size uint64) error
+
+	// ReportBandwidth accounts amount bytes served for the block whose
+	// multihash hex string is cid.
+	ReportBandwidth(ctx context.Context, cid string, amount uint64) error
+}
+
+// StatusError is returned when the pinning service answers with an
+// unexpected HTTP status.
+type StatusError struct {
+	Op         string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("pinning: %s %s: server returned status %d", e.Op, e.URL, e.StatusCode)
+	}
+	return fmt.Sprintf("pinning: %s %s: server returned status %d: %s", e.Op, e.URL, e.StatusCode, e.Body)
+}
+
+// maxErrorBody bounds how much of an error response is kept in StatusError.
+const maxErrorBody = 512
+
+// HTTPClient is a Client talking to the pinning service over HTTP.
+type HTTPClient struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+	retry   retry.Policy
+}
+
+var _ Client = (*HTTPClient)(nil)
+
+// Option configures an HTTPClient.
+type Option func(*HTTPClient)
+
+// WithHTTPClient sets the http.Client used for all requests.
+func WithHTTPClient(c *http.Client) Option {
+	return func(p *HTTPClient) {
+		p.client = c
+	}
+}
+
+// WithRetry sets how failed requests are retried. By default each request is
+// attempted once.
+func WithRetry(p retry.Policy) Option {
+	return func(c *HTTPClient) {
+		c.retry = p
+	}
+}
+
+// New returns an HTTPClient for the pinning service at baseURL,
+// authenticating with apiKey.
+func New(baseURL, apiKey string, opts ...Option) *HTTPClient {
+	p := &HTTPClient{
+		baseURL: baseURL,
+		apiKey:  apiKey,
+		client:  &http.Client{},
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	return p
+}
+
+func (p *HTTPClient) CreateFileRecord(ctx context.Context, userID, fileRecordID string, size uint64) error {
+	return p.post(ctx, "filerecords", fmt.Sprintf("%s/api/filerecords/", p.baseURL), map[string]interface{}{
+		"user_id":        userID,
+		"file_record_id": fileRecordID,
+		"size":           size,
+	})
+}
+
+func (p *HTTPClient) ReportBandwidth(ctx context.Context, cid string, amount uint64) error {
+	return p.post(ctx, "hourlyUsage", fmt.Sprintf("%s/api/hourlyUsage/bandwidth/", p.baseURL), map[string]interface{}{
+		"amount": amount,
+		"cid":    cid,
+	})
+}
+
+func (p *HTTPClient) post(ctx context.Context, op, endpoint string, body interface{}) error {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+	return retry.Do(ctx, p.retry, op, func(key string) error {
+		return p.postOnce(ctx, op, endpoint, reqBody, key)
+	})
+}
+
+func (p *HTTPClient) postOnce(ctx context.Context, op, endpoint string, reqBody []byte, idempotencyKey string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("blockservice-API-Key", p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		req.Header.Set(p.retry.IdempotencyHeader, idempotencyKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to send HTTP request: %w", err)
+		if ctx.Err() != nil {
+			return err
+		}
+		return retry.Retry(err, 0)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		serr := &StatusError{Op: op, URL: endpoint, StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(msg))}
+		if p.retry.Retryable(resp.StatusCode) {
+			return retry.Retry(serr, retryAfter(resp))
+		}
+		return serr
+	}
+	// Drain the body so that the connection can be reused.
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// retryAfter returns the delay requested by the Retry-After header of resp,
+// if any.
+func retryAfter(resp *http.Response) time.Duration {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs <= 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
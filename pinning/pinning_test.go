@@ -0,0 +1,76 @@
+package pinning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-blockservice/retry"
+)
+
+func TestHTTPClient(t *testing.T) {
+	var got []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("blockservice-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		body["path"] = r.URL.Path
+		got = append(got, body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New(srv.URL, "secret", WithHTTPClient(srv.Client()))
+	if err := c.CreateFileRecord(ctx, "alice", "rec", 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ReportBandwidth(ctx, "1220ab", 7); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(got))
+	}
+	if got[0]["path"] != "/api/filerecords/" || got[0]["user_id"] != "alice" || got[0]["file_record_id"] != "rec" || got[0]["size"] != float64(42) {
+		t.Fatalf("unexpected file record request %v", got[0])
+	}
+	if got[1]["path"] != "/api/hourlyUsage/bandwidth/" || got[1]["cid"] != "1220ab" || got[1]["amount"] != float64(7) {
+		t.Fatalf("unexpected bandwidth request %v", got[1])
+	}
+
+	err := New(srv.URL, "wrong", WithHTTPClient(srv.Client())).ReportBandwidth(ctx, "1220ab", 7)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a 401 StatusError, got %v", err)
+	}
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	policy := retry.Policy{MaxAttempts: 2, RetryableStatus: []int{http.StatusBadGateway}}
+	c := New(srv.URL, "secret", WithHTTPClient(srv.Client()), WithRetry(policy))
+	if err := c.CreateFileRecord(context.Background(), "alice", "rec", 42); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+}
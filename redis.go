@@ -0,0 +1,89 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisTopology selects how the Redis deployment holding the CID index is
+// reached.
+type RedisTopology int
+
+const (
+	// RedisCluster talks to a Redis Cluster, using Addrs as seed nodes.
+	RedisCluster RedisTopology = iota
+	// RedisFailover talks to a Sentinel managed master named MasterName,
+	// using Addrs as the sentinel addresses.
+	RedisFailover
+	// RedisSingle talks to the single node at Addrs[0].
+	RedisSingle
+)
+
+func (t RedisTopology) String() string {
+	switch t {
+	case RedisCluster:
+		return "cluster"
+	case RedisFailover:
+		return "failover"
+	case RedisSingle:
+		return "single"
+	default:
+		return fmt.Sprintf("RedisTopology(%d)", int(t))
+	}
+}
+
+// RedisOptions configures the Redis client built by NewRedisClient.
+// Credentials, TLS, pool sizes and timeouts are taken from the embedded
+// redis.UniversalOptions.
+type RedisOptions struct {
+	redis.UniversalOptions
+
+	Topology RedisTopology
+}
+
+// NewRedisClient builds a Redis client for the given topology and checks
+// that it is reachable. The returned client is meant to be passed to
+// WithRedis, and is owned by the caller.
+func NewRedisClient(ctx context.Context, opts *RedisOptions) (redis.UniversalClient, error) {
+	if opts == nil || len(opts.Addrs) == 0 {
+		return nil, errors.New("blockservice: no redis addresses configured")
+	}
+
+	var rdb redis.UniversalClient
+	switch opts.Topology {
+	case RedisCluster:
+		rdb = redis.NewClusterClient(opts.Cluster())
+	case RedisFailover:
+		if opts.MasterName == "" {
+			return nil, errors.New("blockservice: redis failover topology requires a master name")
+		}
+		rdb = redis.NewFailoverClient(opts.Failover())
+	case RedisSingle:
+		rdb = redis.NewClient(opts.Simple())
+	default:
+		return nil, fmt.Errorf("blockservice: unknown redis topology %s", opts.Topology)
+	}
+
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("blockservice: ping redis %s %v: %w", opts.Topology, opts.Addrs, err)
+	}
+	return rdb, nil
+}
+
+// redisPingTimeout bounds the ping of the client given to WithRedis.
+const redisPingTimeout = 5 * time.Second
+
+// pingRedis checks that rdb is reachable within redisPingTimeout.
+func pingRedis(rdb redis.UniversalClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisPingTimeout)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("blockservice: ping redis: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package blockservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestNewRedisClientRequiresAddrs(t *testing.T) {
+	_, err := NewRedisClient(context.Background(), &RedisOptions{})
+	if err == nil {
+		t.Fatal("expected an error without addresses")
+	}
+}
+
+func TestNewRedisClientFailsOnPing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, topology := range []RedisTopology{RedisSingle, RedisCluster} {
+		_, err := NewRedisClient(ctx, &RedisOptions{
+			Topology: topology,
+			UniversalOptions: redis.UniversalOptions{
+				Addrs:       []string{"127.0.0.1:1"},
+				DialTimeout: 100 * time.Millisecond,
+				MaxRetries:  -1,
+			},
+		})
+		if err == nil {
+			t.Fatalf("%s: expected ping to fail against a closed port", topology)
+		}
+	}
+}
+
+func TestPingRedis(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond, MaxRetries: -1})
+	defer rdb.Close()
+	if err := pingRedis(rdb); err == nil {
+		t.Fatal("expected ping to fail against a closed port")
+	}
+}
+
+func TestNewRedisClientFailoverNeedsMaster(t *testing.T) {
+	_, err := NewRedisClient(context.Background(), &RedisOptions{
+		Topology:         RedisFailover,
+		UniversalOptions: redis.UniversalOptions{Addrs: []string{"127.0.0.1:26379"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error without a master name")
+	}
+}
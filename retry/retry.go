@@ -0,0 +1,163 @@
+// Package retry implements the retry policy shared by the clients of the
+// uploader and of the pinning service.
+package retry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Policy controls how failed calls are retried. The zero Policy makes a single
+// attempt.
+type Policy struct {
+	// MaxAttempts bounds the number of attempts of a call, including the
+	// first one.
+	MaxAttempts int
+	// BaseDelay is the upper bound of the delay before the first retry. It
+	// doubles with every retry, up to MaxDelay, and the actual delay is
+	// drawn uniformly below it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// RetryableStatus lists the HTTP status codes worth retrying. Transport
+	// errors are always retried.
+	RetryableStatus []int
+	// IdempotencyHeader is the request header carrying a key identifying a
+	// call across its attempts, so that the server can detect replays. No
+	// key is sent if it is empty.
+	IdempotencyHeader string
+}
+
+// DefaultPolicy is the Policy used unless configured otherwise.
+var DefaultPolicy = Policy{
+	MaxAttempts:       4,
+	BaseDelay:         100 * time.Millisecond,
+	MaxDelay:          5 * time.Second,
+	RetryableStatus:   []int{408, 429, 500, 502, 503, 504},
+	IdempotencyHeader: "Idempotency-Key",
+}
+
+// Retryable reports whether a call answered with status should be
+// retried.
+func (p Policy) Retryable(status int) bool {
+	for _, s := range p.RetryableStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the delay before the given retry, starting at 1.
+func (p Policy) Backoff(retry int) time.Duration {
+	max := p.BaseDelay
+	for i := 1; i < retry && max < p.MaxDelay; i++ {
+		max *= 2
+	}
+	if p.MaxDelay > 0 && max > p.MaxDelay {
+		max = p.MaxDelay
+	}
+	if max <= 0 {
+		return 0
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return max
+	}
+	return time.Duration(n.Int64())
+}
+
+// retryableError marks an error as worth retrying.
+type retryableError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Retry marks err as worth retrying. A positive after is the delay requested
+// by the server, it overrides the backoff if longer, up to the MaxDelay of the
+// policy.
+func Retry(err error, after time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err, after: after}
+}
+
+// Do calls fn until it succeeds, returns an error not marked with Retry, the
+// attempts of p are exhausted or ctx is done. The last error of fn is
+// returned, without its Retry mark. fn receives the idempotency key of the
+// call, which is empty if p has no IdempotencyHeader, and is the key set
+// with WithKey or a random one otherwise.
+//
+// Retries are recorded as events of the span of ctx, and their count as its
+// op.retries attribute.
+func Do(ctx context.Context, p Policy, op string, fn func(key string) error) error {
+	var key string
+	if p.IdempotencyHeader != "" {
+		key, _ = ctx.Value(keyContextKey{}).(string)
+		if key == "" {
+			key = newKey()
+		}
+	}
+	span := trace.SpanFromContext(ctx)
+
+	for attempt := 1; ; attempt++ {
+		err := fn(key)
+		var rerr *retryableError
+		if !errors.As(err, &rerr) {
+			return err
+		}
+		if attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return rerr.err
+		}
+
+		delay := p.Backoff(attempt)
+		if rerr.after > delay {
+			delay = rerr.after
+		}
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+		span.AddEvent("retry", trace.WithAttributes(
+			attribute.String("op", op),
+			attribute.Int("attempt", attempt),
+			attribute.String("error", rerr.err.Error()),
+			attribute.Int64("delay_ms", delay.Milliseconds()),
+		))
+		span.SetAttributes(attribute.Int(op+".retries", attempt))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return rerr.err
+		}
+	}
+}
+
+type keyContextKey struct{}
+
+// WithKey returns a context making Do use key as the idempotency key of the
+// calls made with it, instead of a random one, for instance to record it
+// before the call.
+func WithKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, keyContextKey{}, key)
+}
+
+func newKey() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,136 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for retry, max := range map[int]time.Duration{1: 10, 2: 20, 3: 40, 4: 50, 10: 50} {
+		for i := 0; i < 100; i++ {
+			if d := p.Backoff(retry); d < 0 || d >= max*time.Millisecond {
+				t.Fatalf("retry %d: backoff %s out of [0, %dms)", retry, d, max)
+			}
+		}
+	}
+	if d := (Policy{}).Backoff(3); d != 0 {
+		t.Fatalf("expected no backoff without delays, got %s", d)
+	}
+}
+
+// recordingSpan records the retries reported by Do.
+type recordingSpan struct {
+	trace.Span
+	lk      sync.Mutex
+	events  int
+	retries int64
+}
+
+func (s *recordingSpan) AddEvent(name string, opts ...trace.EventOption) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.events++
+}
+
+func (s *recordingSpan) SetAttributes(kvs ...attribute.KeyValue) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	for _, kv := range kvs {
+		if kv.Key == "upload.retries" {
+			s.retries = kv.Value.AsInt64()
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	p := Policy{MaxAttempts: 3, IdempotencyHeader: "Idempotency-Key"}
+	span := &recordingSpan{Span: trace.SpanFromContext(context.Background())}
+	ctx := trace.ContextWithSpan(context.Background(), span)
+	transient := errors.New("transient")
+
+	var keys []string
+	err := Do(ctx, p, "upload", func(key string) error {
+		keys = append(keys, key)
+		if len(keys) < 3 {
+			return Retry(transient, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Fatalf("expected 3 attempts sharing an idempotency key, got %q", keys)
+	}
+	if span.events != 2 || span.retries != 2 {
+		t.Fatalf("expected 2 retries in the span, got %d events and %d retries", span.events, span.retries)
+	}
+
+	attempts := 0
+	err = Do(context.Background(), p, "upload", func(string) error {
+		attempts++
+		return Retry(transient, 0)
+	})
+	if err != transient || attempts != 3 {
+		t.Fatalf("expected the unmarked last error after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	attempts = 0
+	fatal := errors.New("fatal")
+	err = Do(context.Background(), p, "upload", func(string) error {
+		attempts++
+		return fatal
+	})
+	if err != fatal || attempts != 1 {
+		t.Fatalf("expected unmarked errors not to be retried, got %v after %d attempts", err, attempts)
+	}
+
+	cctx, cancel := context.WithCancel(context.Background())
+	attempts = 0
+	err = Do(cctx, Policy{MaxAttempts: 10, BaseDelay: time.Hour, MaxDelay: time.Hour}, "upload", func(string) error {
+		attempts++
+		cancel()
+		return Retry(transient, 0)
+	})
+	if err != transient || attempts != 1 {
+		t.Fatalf("expected retries to stop with the context, got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestDoCapsRetryAfter(t *testing.T) {
+	p := Policy{MaxAttempts: 2, MaxDelay: 10 * time.Millisecond}
+	start := time.Now()
+	attempts := 0
+	err := Do(context.Background(), p, "upload", func(string) error {
+		attempts++
+		if attempts == 1 {
+			return Retry(errors.New("throttled"), time.Hour)
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("expected a retry, got %v after %d attempts", err, attempts)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("expected the server delay to be capped at MaxDelay, waited %s", d)
+	}
+}
+
+func TestDoWithKey(t *testing.T) {
+	p := Policy{MaxAttempts: 1, IdempotencyHeader: "Idempotency-Key"}
+	var got string
+	err := Do(WithKey(context.Background(), "journaled"), p, "upload", func(key string) error {
+		got = key
+		return nil
+	})
+	if err != nil || got != "journaled" {
+		t.Fatalf("expected the key set on the context, got %q, %v", got, err)
+	}
+}
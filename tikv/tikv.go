@@ -1,11 +1,13 @@
 package tikv
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	// "os"
 
+	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/txnkv"
 )
 
@@ -19,28 +21,75 @@ func (kv KV) String() string {
 }
 
 var (
-	client *txnkv.Client
+	client *Client
 	pdAddr = flag.String("pd", "127.0.0.1:2379", "pd address")
 )
 
+// Client is a transactional TiKV client. Unlike the package level helpers,
+// several clients talking to different clusters can coexist.
+type Client struct {
+	txn *txnkv.Client
+}
+
+// NewClient connects to the TiKV cluster behind the given PD addresses.
+func NewClient(addrs []string) (*Client, error) {
+	txn, err := txnkv.NewClient(addrs)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{txn: txn}, nil
+}
+
+// Close releases the connections held by the client.
+func (c *Client) Close() error {
+	return c.txn.Close()
+}
+
+// IsNotFound reports whether err means that the requested key does not exist.
+func IsNotFound(err error) bool {
+	return tikverr.IsErrNotFound(err)
+}
+
 // Init initializes information.
 func InitStore(tikvStore string) {
 	var err error
 	addrs := []string{*pdAddr}
-  
+
 	if tikvStore != "" {
-	  addrs = []string{tikvStore}
+		addrs = []string{tikvStore}
 	}
-  
-	client, err = txnkv.NewClient(addrs)
+
+	client, err = NewClient(addrs)
 	if err != nil {
-	  panic(err)
+		panic(err)
 	}
 }
 
+// Default returns the client set up by InitStore.
+func Default() *Client {
+	return client
+}
+
 // key1 val1 key2 val2 ...
 func Puts(args ...[]byte) error {
-	tx, err := client.Begin()
+	return client.Puts(context.Background(), args...)
+}
+
+func Get(k []byte) (KV, error) {
+	return client.Get(context.TODO(), k)
+}
+
+func Dels(keys ...[]byte) error {
+	return client.Dels(context.Background(), keys...)
+}
+
+func Scan(keyPrefix []byte, limit int) ([]KV, error) {
+	return client.Scan(context.Background(), keyPrefix, limit)
+}
+
+// key1 val1 key2 val2 ...
+func (c *Client) Puts(ctx context.Context, args ...[]byte) error {
+	tx, err := c.txn.Begin()
 	if err != nil {
 		return err
 	}
@@ -49,40 +98,52 @@ func Puts(args ...[]byte) error {
 		key, val := args[i], args[i+1]
 		err := tx.Set(key, val)
 		if err != nil {
+			tx.Rollback()
 			return err
 		}
 	}
-	return tx.Commit(context.Background())
+	return tx.Commit(ctx)
 }
 
-func Get(k []byte) (KV, error) {
-	tx, err := client.Begin()
+func (c *Client) Get(ctx context.Context, k []byte) (KV, error) {
+	tx, err := c.txn.Begin()
 	if err != nil {
 		return KV{}, err
 	}
-	v, err := tx.Get(context.TODO(), k)
+	v, err := tx.Get(ctx, k)
 	if err != nil {
 		return KV{}, err
 	}
 	return KV{K: k, V: v}, nil
 }
 
-func Dels(keys ...[]byte) error {
-	tx, err := client.Begin()
+// BatchGet returns the values of the existing keys among keys, indexed by
+// key.
+func (c *Client) BatchGet(ctx context.Context, keys ...[]byte) (map[string][]byte, error) {
+	tx, err := c.txn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return tx.BatchGet(ctx, keys)
+}
+
+func (c *Client) Dels(ctx context.Context, keys ...[]byte) error {
+	tx, err := c.txn.Begin()
 	if err != nil {
 		return err
 	}
 	for _, key := range keys {
 		err := tx.Delete(key)
 		if err != nil {
+			tx.Rollback()
 			return err
 		}
 	}
-	return tx.Commit(context.Background())
+	return tx.Commit(ctx)
 }
 
-func Scan(keyPrefix []byte, limit int) ([]KV, error) {
-	tx, err := client.Begin()
+func (c *Client) Scan(ctx context.Context, keyPrefix []byte, limit int) ([]KV, error) {
+	tx, err := c.txn.Begin()
 	if err != nil {
 		return nil, err
 	}
@@ -100,6 +161,84 @@ func Scan(keyPrefix []byte, limit int) ([]KV, error) {
 	return ret, nil
 }
 
+// CompareAndSwap sets key to new if its current value is old, in a single
+// transaction. A nil old means that the key must not exist, and a nil new
+// deletes it. It reports whether the swap happened; losing a write conflict
+// against a concurrent transaction is not an error.
+func (c *Client) CompareAndSwap(ctx context.Context, key, old, new []byte) (bool, error) {
+	tx, err := c.txn.Begin()
+	if err != nil {
+		return false, err
+	}
+	cur, err := tx.Get(ctx, key)
+	switch {
+	case IsNotFound(err):
+		cur = nil
+	case err != nil:
+		tx.Rollback()
+		return false, err
+	}
+	if (old == nil) != (cur == nil) || !bytes.Equal(cur, old) {
+		tx.Rollback()
+		return false, nil
+	}
+	if new == nil {
+		err = tx.Delete(key)
+	} else {
+		err = tx.Set(key, new)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		if tikverr.IsErrWriteConflict(err) || tikverr.IsErrKeyExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Iter calls fn for every pair whose key starts with keyPrefix, in key order,
+// until fn returns an error.
+func (c *Client) Iter(ctx context.Context, keyPrefix []byte, fn func(KV) error) error {
+	tx, err := c.txn.Begin()
+	if err != nil {
+		return err
+	}
+	it, err := tx.Iter(keyPrefix, prefixEnd(keyPrefix))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Valid() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(KV{K: it.Key()[:], V: it.Value()[:]}); err != nil {
+			return err
+		}
+		if err := it.Next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 // func main() {
 // 	pdAddr := os.Getenv("PD_ADDR")
 // 	if pdAddr != "" {
@@ -135,4 +274,4 @@ func Scan(keyPrefix []byte, limit int) ([]KV, error) {
 // 	if err != nil {
 // 		panic(err)
 // 	}
-// }
\ No newline at end of file
+// }
@@ -0,0 +1,126 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Mock is an in-memory Client storing packs as plain concatenations of their
+// parts. It is meant for tests.
+type Mock struct {
+	lk     sync.Mutex
+	packs  map[string][]byte
+	files  map[string][]File
+	nextID int
+
+	// Uploads, Appends, Reads and Deletes count the calls made to the mock.
+	Uploads, Appends, Reads, Deletes int
+}
+
+var _ Client = (*Mock)(nil)
+
+// NewMock returns an empty Mock.
+func NewMock() *Mock {
+	return &Mock{
+		packs: make(map[string][]byte),
+		files: make(map[string][]File),
+	}
+}
+
+func (m *Mock) Upload(ctx context.Context, parts []Part) (*PackResponse, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.Uploads++
+
+	m.nextID++
+	id := fmt.Sprintf("pack-%d", m.nextID)
+	m.packs[id] = nil
+	zr, err := m.appendLocked(id, parts)
+	if err != nil {
+		return nil, err
+	}
+	return &PackResponse{
+		FileRecord: FileRecord{ID: id, Size: int(zr.Size())},
+		ZipReader:  *zr,
+	}, nil
+}
+
+func (m *Mock) Append(ctx context.Context, fileRecordID string, parts []Part) (*ZipReader, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.Appends++
+
+	if _, ok := m.packs[fileRecordID]; !ok {
+		return nil, &StatusError{Op: "zipAction", URL: fileRecordID, StatusCode: http.StatusNotFound}
+	}
+	return m.appendLocked(fileRecordID, parts)
+}
+
+func (m *Mock) appendLocked(id string, parts []Part) (*ZipReader, error) {
+	for _, p := range parts {
+		r, err := p.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(len(data))
+		m.files[id] = append(m.files[id], File{
+			Name:               p.Name,
+			CompressedSize:     uint32(size),
+			UncompressedSize:   uint32(size),
+			CompressedSize64:   size,
+			UncompressedSize64: size,
+			Offset:             uint64(len(m.packs[id])),
+		})
+		m.packs[id] = append(m.packs[id], data...)
+	}
+	return &ZipReader{File: append([]File(nil), m.files[id]...)}, nil
+}
+
+func (m *Mock) ReadRange(ctx context.Context, fileRecordID string, offset, size uint64) ([]byte, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.Reads++
+
+	pack, ok := m.packs[fileRecordID]
+	if !ok || offset+size > uint64(len(pack)) {
+		return nil, &StatusError{Op: "cacheFile", URL: fileRecordID, StatusCode: http.StatusNotFound}
+	}
+	return append([]byte(nil), pack[offset:offset+size]...), nil
+}
+
+func (m *Mock) Delete(ctx context.Context, fileRecordID string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.Deletes++
+
+	if _, ok := m.packs[fileRecordID]; !ok {
+		return &StatusError{Op: "packDelete", URL: fileRecordID, StatusCode: http.StatusNotFound}
+	}
+	delete(m.packs, fileRecordID)
+	delete(m.files, fileRecordID)
+	return nil
+}
+
+// Has reports whether the pack fileRecordID exists.
+func (m *Mock) Has(fileRecordID string) bool {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	_, ok := m.packs[fileRecordID]
+	return ok
+}
+
+// Corrupt overwrites the content of a pack at offset, for tests exercising
+// integrity checks.
+func (m *Mock) Corrupt(fileRecordID string, offset uint64, data []byte) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	copy(m.packs[fileRecordID][offset:], data)
+}
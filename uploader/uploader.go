@@ -0,0 +1,411 @@
+// Package uploader implements a client for the uploader service storing
+// blocks in zip packs and serving byte ranges of them back through its CDN.
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ipfs/go-blockservice/retry"
+)
+
+// Client is the set of uploader operations used by the blockservice.
+type Client interface {
+	// Upload stores parts in a new pack.
+	Upload(ctx context.Context, parts []Part) (*PackResponse, error)
+
+	// Append adds parts at the end of an existing pack, and returns the
+	// listing of the whole pack.
+	Append(ctx context.Context, fileRecordID string, parts []Part) (*ZipReader, error)
+
+	// ReadRange returns size bytes of a pack starting at offset.
+	ReadRange(ctx context.Context, fileRecordID string, offset, size uint64) ([]byte, error)
+
+	// Delete removes a pack. Deleting a missing pack fails with an error
+	// matching ErrNotFound, it is up to the caller to decide whether the
+	// pack is gone. Clients that do not know how to delete packs fail with
+	// ErrDeleteUnsupported.
+	Delete(ctx context.Context, fileRecordID string) error
+}
+
+// ZipReader is the listing of the files stored in a pack.
+type ZipReader struct {
+	File []File
+}
+
+// Size returns the number of bytes used by the files of the pack.
+func (z *ZipReader) Size() uint64 {
+	if len(z.File) == 0 {
+		return 0
+	}
+	last := z.File[len(z.File)-1]
+	return last.Offset + last.UncompressedSize64
+}
+
+// File describes a file stored in a pack.
+type File struct {
+	Name               string `json:"Name"`
+	CompressedSize     uint32 `json:"CompressedSize"`
+	UncompressedSize   uint32 `json:"UncompressedSize"`
+	CompressedSize64   uint64 `json:"CompressedSize64"`
+	UncompressedSize64 uint64 `json:"UncompressedSize64"`
+	Offset             uint64 `json:"Offset"`
+}
+
+// FileRecord is the record created by the uploader for a new pack.
+type FileRecord struct {
+	ID       string `json:"ID"`
+	Owner    string `json:"owner"`
+	Name     string `json:"name"`
+	Size     int    `json:"size"`
+	ReaderID int    `json:"readerId"`
+}
+
+// PackResponse is returned by the uploader when a new pack is created.
+type PackResponse struct {
+	FileRecord FileRecord
+	ZipReader  ZipReader
+}
+
+// Part is a file to be stored in a pack.
+type Part struct {
+	Name string
+	// Open returns the content of the part. It may be called more than
+	// once, each call must return the full content.
+	Open func() (io.ReadCloser, error)
+}
+
+// FilePart returns a Part reading the file at path, named after its base
+// name.
+func FilePart(path string) Part {
+	return Part{
+		Name: filepath.Base(path),
+		Open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}
+}
+
+// BytesPart returns a Part holding data.
+func BytesPart(name string, data []byte) Part {
+	return Part{
+		Name: name,
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+}
+
+var (
+	// ErrNotFound is matched by StatusErrors for missing packs or ranges.
+	ErrNotFound = errors.New("uploader: not found")
+	// ErrThrottled is matched by StatusErrors asking the client to slow
+	// down.
+	ErrThrottled = errors.New("uploader: throttled")
+	// ErrServer is matched by StatusErrors for other server side failures.
+	ErrServer = errors.New("uploader: server failure")
+	// ErrRangeSize is returned when a range read returns more or fewer
+	// bytes than requested.
+	ErrRangeSize = errors.New("uploader: range size mismatch")
+	// ErrDeleteUnsupported is returned by Delete when no endpoint deleting
+	// packs is configured.
+	ErrDeleteUnsupported = errors.New("uploader: no delete endpoint configured")
+)
+
+// StatusError is returned when the uploader answers with an unexpected HTTP
+// status. Depending on the status it matches ErrNotFound, ErrThrottled or
+// ErrServer with errors.Is.
+type StatusError struct {
+	Op         string
+	URL        string
+	StatusCode int
+	// RetryAfter is the delay requested by the server through the
+	// Retry-After header, if any.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("uploader: %s %s: server returned status %d", e.Op, e.URL, e.StatusCode)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone:
+		return ErrNotFound
+	case e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable:
+		return ErrThrottled
+	case e.StatusCode >= 500:
+		return ErrServer
+	default:
+		return nil
+	}
+}
+
+func newStatusError(op string, req *http.Request, resp *http.Response) *StatusError {
+	e := &StatusError{Op: op, URL: req.URL.String(), StatusCode: resp.StatusCode}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+// HTTPClient is a Client talking to the uploader over HTTP.
+type HTTPClient struct {
+	baseURL    string
+	client     *http.Client
+	retry      retry.Policy
+	deletePath string
+}
+
+var _ Client = (*HTTPClient)(nil)
+
+// Option configures an HTTPClient.
+type Option func(*HTTPClient)
+
+// WithHTTPClient sets the http.Client used for all requests. It is shared
+// by every call so that connections are reused.
+func WithHTTPClient(c *http.Client) Option {
+	return func(u *HTTPClient) {
+		u.client = c
+	}
+}
+
+// WithRetry sets how failed requests are retried. By default each request is
+// attempted once.
+func WithRetry(p retry.Policy) Option {
+	return func(u *HTTPClient) {
+		u.retry = p
+	}
+}
+
+// WithDeletePath sets the path, relative to the base URL, of the endpoint
+// deleting packs. The uploader API does not document the deletion of packs,
+// Delete assumes that DELETE {baseURL}/{path}/{fileRecordID} removes a pack
+// and answers 200 or 204. Without it, Delete fails with ErrDeleteUnsupported.
+func WithDeletePath(path string) Option {
+	return func(u *HTTPClient) {
+		u.deletePath = path
+	}
+}
+
+// New returns an HTTPClient for the uploader at baseURL.
+func New(baseURL string, opts ...Option) *HTTPClient {
+	u := &HTTPClient{
+		baseURL: baseURL,
+		client:  &http.Client{},
+	}
+	for _, o := range opts {
+		o(u)
+	}
+	return u
+}
+
+// URL returns the base URL of the uploader.
+func (u *HTTPClient) URL() string {
+	return u.baseURL
+}
+
+func (u *HTTPClient) Upload(ctx context.Context, parts []Part) (*PackResponse, error) {
+	var response PackResponse
+	err := u.postParts(ctx, "packUpload", fmt.Sprintf("%s/packUpload", u.baseURL), parts, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (u *HTTPClient) Append(ctx context.Context, fileRecordID string, parts []Part) (*ZipReader, error) {
+	endpoint := fmt.Sprintf("%s/zipAction?%s", u.baseURL, url.Values{
+		"file_record_id": {fileRecordID},
+		"action_type":    {"1"},
+	}.Encode())
+
+	var response ZipReader
+	err := u.postParts(ctx, "zipAction", endpoint, parts, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+func (u *HTTPClient) ReadRange(ctx context.Context, fileRecordID string, offset, size uint64) ([]byte, error) {
+	endpoint, err := url.Parse(fmt.Sprintf("%s/cacheFile/%s", u.baseURL, fileRecordID))
+	if err != nil {
+		return nil, err
+	}
+	rawQuery := endpoint.Query()
+	rawQuery.Set("range", fmt.Sprintf("%d,%d", offset, size))
+	endpoint.RawQuery = rawQuery.Encode()
+
+	var data []byte
+	err = retry.Do(ctx, u.retry, "cacheFile", func(string) error {
+		data, err = u.readRange(ctx, endpoint.String(), size)
+		return err
+	})
+	return data, err
+}
+
+// Delete removes a pack through the endpoint set with WithDeletePath. A 404
+// is reported as an error matching ErrNotFound rather than as a deleted
+// pack, as it is also what a wrong endpoint answers.
+func (u *HTTPClient) Delete(ctx context.Context, fileRecordID string) error {
+	if u.deletePath == "" {
+		return ErrDeleteUnsupported
+	}
+	endpoint := fmt.Sprintf("%s/%s/%s", u.baseURL, u.deletePath, url.PathEscape(fileRecordID))
+	return retry.Do(ctx, u.retry, "packDelete", func(string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create HTTP request: %w", err)
+		}
+		resp, err := u.client.Do(req)
+		if err != nil {
+			return u.transportError(ctx, err)
+		}
+		defer drainAndClose(resp.Body)
+
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusNoContent:
+			return nil
+		}
+		return u.statusError("packDelete", req, resp)
+	})
+}
+
+func (u *HTTPClient) readRange(ctx context.Context, endpoint string, size uint64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, u.transportError(ctx, err)
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, u.statusError("cacheFile", req, resp)
+	}
+
+	// Never read more than the range asked for, a misbehaving server must
+	// not make us buffer a whole pack.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(size)+1))
+	if err != nil {
+		return nil, u.transportError(ctx, err)
+	}
+	if uint64(len(data)) != size {
+		return nil, fmt.Errorf("%w: %s returned %d bytes, expected %d", ErrRangeSize, req.URL, len(data), size)
+	}
+	return data, nil
+}
+
+// transportError marks err, which happened while talking to the uploader, as
+// worth retrying unless ctx is done.
+func (u *HTTPClient) transportError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	return retry.Retry(err, 0)
+}
+
+// statusError returns the StatusError for resp, marked as worth retrying if
+// the retry policy says so.
+func (u *HTTPClient) statusError(op string, req *http.Request, resp *http.Response) error {
+	e := newStatusError(op, req, resp)
+	if u.retry.Retryable(e.StatusCode) {
+		return retry.Retry(e, e.RetryAfter)
+	}
+	return e
+}
+
+// maxDrain bounds how much of an unread response body is discarded to allow
+// the connection to be reused.
+const maxDrain = 64 << 10
+
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
+}
+
+func (u *HTTPClient) postParts(ctx context.Context, op, endpoint string, parts []Part, response interface{}) error {
+	return retry.Do(ctx, u.retry, op, func(key string) error {
+		return u.postPartsOnce(ctx, op, endpoint, parts, response, key)
+	})
+}
+
+func (u *HTTPClient) postPartsOnce(ctx context.Context, op, endpoint string, parts []Part, response interface{}, idempotencyKey string) error {
+	// Stream the multipart body straight from the parts instead of
+	// buffering the whole pack in memory.
+	body, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeParts(writer, parts))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		body.CloseWithError(err)
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if idempotencyKey != "" {
+		req.Header.Set(u.retry.IdempotencyHeader, idempotencyKey)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		body.CloseWithError(err)
+		return u.transportError(ctx, fmt.Errorf("failed to send HTTP request: %w", err))
+	}
+	defer drainAndClose(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return u.statusError(op, req, resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("failed to decode response body: %w", err)
+	}
+	return nil
+}
+
+func writeParts(writer *multipart.Writer, parts []Part) error {
+	// Iterate over parts and add them as form files
+	for _, p := range parts {
+		if err := writePart(writer, p); err != nil {
+			return err
+		}
+	}
+
+	// Close the multipart form writer
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close multipart writer: %w", err)
+	}
+	return nil
+}
+
+func writePart(writer *multipart.Writer, p Part) error {
+	w, err := writer.CreateFormFile("file", p.Name)
+	if err != nil {
+		return fmt.Errorf("failed to create form file: %w", err)
+	}
+	r, err := p.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open part %s: %w", p.Name, err)
+	}
+	defer r.Close()
+	if _, err = io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to copy part content: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-blockservice/retry"
+)
+
+func TestHTTPClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/packUpload", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+		}
+		fh := r.MultipartForm.File["file"]
+		if len(fh) != 2 || fh[0].Filename != "a" || fh[1].Filename != "b" {
+			t.Errorf("unexpected parts %v", fh)
+		}
+		json.NewEncoder(w).Encode(PackResponse{
+			FileRecord: FileRecord{ID: "rec"},
+			ZipReader: ZipReader{File: []File{
+				{Name: "a", UncompressedSize64: 3, Offset: 30},
+				{Name: "b", UncompressedSize64: 4, Offset: 63},
+			}},
+		})
+	})
+	mux.HandleFunc("/zipAction", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("file_record_id") != "rec" || q.Get("action_type") != "1" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(ZipReader{File: []File{{Name: "c", UncompressedSize64: 5, Offset: 100}}})
+	})
+	mux.HandleFunc("/cacheFile/rec", func(w http.ResponseWriter, r *http.Request) {
+		if rng := r.URL.Query().Get("range"); rng != "30,3" {
+			t.Errorf("unexpected range %q", rng)
+		}
+		io.WriteString(w, "abc")
+	})
+	mux.HandleFunc("/packs/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if r.URL.Path != "/packs/rec" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New(srv.URL, WithHTTPClient(srv.Client()), WithDeletePath("packs"))
+
+	pack, err := c.Upload(ctx, []Part{BytesPart("a", []byte("abc")), BytesPart("b", []byte("defg"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pack.FileRecord.ID != "rec" || pack.ZipReader.Size() != 67 {
+		t.Fatalf("unexpected pack %+v", pack)
+	}
+
+	zr, err := c.Append(ctx, "rec", []Part{BytesPart("c", []byte("hello"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zr.Size() != 105 {
+		t.Fatalf("unexpected pack size %d", zr.Size())
+	}
+
+	data, err := c.ReadRange(ctx, "rec", 30, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abc" {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	_, err = c.ReadRange(ctx, "missing", 0, 1)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a 404 StatusError, got %v", err)
+	}
+
+	if err := c.Delete(ctx, "rec"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected deleting a missing pack to fail with ErrNotFound, got %v", err)
+	}
+}
+
+func TestDeletePath(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Path != "/packs/rec" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	if err := New(srv.URL, WithHTTPClient(srv.Client())).Delete(ctx, "rec"); !errors.Is(err, ErrDeleteUnsupported) {
+		t.Fatalf("expected deletes to be disabled by default, got %v", err)
+	}
+	if err := New(srv.URL, WithHTTPClient(srv.Client()), WithDeletePath("packs")).Delete(ctx, "rec"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadRangeErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cacheFile/throttled":
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/cacheFile/broken":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/cacheFile/gone":
+			w.WriteHeader(http.StatusNotFound)
+		case "/cacheFile/long":
+			io.WriteString(w, "way more than asked for")
+		case "/cacheFile/short":
+			io.WriteString(w, "ab")
+		case "/cacheFile/slow":
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := New(srv.URL, WithHTTPClient(srv.Client()))
+
+	_, err := c.ReadRange(ctx, "throttled", 0, 3)
+	var serr *StatusError
+	if !errors.Is(err, ErrThrottled) || !errors.As(err, &serr) || serr.RetryAfter != 3*time.Second {
+		t.Fatalf("expected a throttled error with Retry-After, got %v", err)
+	}
+	if _, err := c.ReadRange(ctx, "broken", 0, 3); !errors.Is(err, ErrServer) {
+		t.Fatalf("expected a server error, got %v", err)
+	}
+	if _, err := c.ReadRange(ctx, "gone", 0, 3); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	if _, err := c.ReadRange(ctx, "long", 0, 3); !errors.Is(err, ErrRangeSize) {
+		t.Fatalf("expected a range size error for a long body, got %v", err)
+	}
+	if _, err := c.ReadRange(ctx, "short", 0, 3); !errors.Is(err, ErrRangeSize) {
+		t.Fatalf("expected a range size error for a short body, got %v", err)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ReadRange(cctx, "slow", 0, 3); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to honor the context, got %v", err)
+	}
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	var (
+		attempts int
+		keys     []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/packUpload":
+			attempts++
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Error(err)
+			}
+			if attempts < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(PackResponse{FileRecord: FileRecord{ID: "rec"}})
+		case "/cacheFile/rejected":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	policy := retry.Policy{MaxAttempts: 3, RetryableStatus: []int{http.StatusServiceUnavailable}, IdempotencyHeader: "Idempotency-Key"}
+	c := New(srv.URL, WithHTTPClient(srv.Client()), WithRetry(policy))
+
+	pack, err := c.Upload(ctx, []Part{BytesPart("a", []byte("abc"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pack.FileRecord.ID != "rec" || attempts != 3 {
+		t.Fatalf("expected the upload to succeed on the third attempt, got %+v after %d", pack, attempts)
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Fatalf("expected the attempts to share an idempotency key, got %q", keys)
+	}
+
+	_, err = c.ReadRange(ctx, "rejected", 0, 1)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 StatusError, got %v", err)
+	}
+}